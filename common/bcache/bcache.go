@@ -11,40 +11,78 @@ package bcache
  * cache.Set("test2","10000")
  * cache.Expire("test2",120*time.Second)
  * cache.Del("test2")
+ * 限制内存时按LRU淘汰，超过单个值上限的Set被拒绝:
+ * cache := common.NewBcache("test_cache",20).MaxMem(64<<20).MaxValueSize(1<<20)
+ * 同一key并发未命中时只调用一次载入函数，其他调用等待并共享结果:
+ * cache := common.NewBcache("test_cache",20).LoaderFuncContext(loader).LoadTimeout(3*time.Second)
+ * cache.GetContext(ctx,"test1")
+ * 后台定时清理过期成员，不再使用时调用Close停止:
+ * cache := common.NewBcache("test_cache",20).Ttl(120*time.Second).Janitor(time.Second,20)
+ * cache.Close()
  */
 import (
 	"container/list"
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
-	//"fmt"
 	//"encoding/json"
 )
 
 var BcacheKeyNotFound = errors.New("Key not found")
 
+// 每个成员除key与value外的固定开销，包括cItem、链表节点与map项
+const BCACHE_ITEM_OVERHEAD = 128
+
+// 主动过期参考redis：每次随机检查SAMPLE个成员，过期比例超过RATIO时继续下一轮，每次最多ROUNDS轮
+const (
+	BCACHE_JANITOR_SAMPLE = 20
+	BCACHE_JANITOR_RATIO  = 0.25
+	BCACHE_JANITOR_ROUNDS = 16
+)
+
 type Bcache struct {
 	name   string                   //缓存名
 	size   int                      //缓存key成员数量
 	data   map[string]*list.Element //元数据
 	expire *time.Duration           //过期设置
 	mu     sync.RWMutex             //读写锁
-	load   BcacheLoaderFunc         //自动化载入函数
-	mem    int                      //内存占用空间
+	load   BcacheLoaderContextFunc  //自动化载入函数
+	calls  map[string]*loadCall     //正在载入的key
+	loadTo time.Duration            //载入超时，0为不限制
+	mem    int                      //内存占用空间，包括key与固定开销
+	maxMem int                      //内存上限，0为不限制
+	maxVal int                      //单个value的大小上限，0为不限制
 	items  *list.List               //成员访问排序排序链表
 	hit    int32                    //命中缓存
 	miss   int32                    //未命中缓存
+	reject int32                    //超过上限被拒绝的Set
+	swept  int32                    //后台清理的过期成员
+	stop   chan struct{}            //停止后台清理
+	once   sync.Once                //Close只执行一次
 }
 
 type BcacheLoaderFunc func(string) (string, error)
 
+type BcacheLoaderContextFunc func(context.Context, string) (string, error)
+
+// loadCall 一次正在进行的载入，done关闭后value与err可读
+type loadCall struct {
+	done  chan struct{}
+	value string
+	err   error
+	dirty bool //载入期间key被Set或Del，载入结果不再写入缓存
+}
+
 func NewBcache(name string, lenght int) *Bcache {
 	c := &Bcache{
 		name:  name,
 		size:  lenght,
 		data:  make(map[string]*list.Element, lenght),
 		items: list.New(),
+		calls: make(map[string]*loadCall),
 	}
 	//go c.reportStat() // 配合log.ied.com使用，默认注释掉
 	return c
@@ -54,13 +92,29 @@ func NewBcache(name string, lenght int) *Bcache {
  * 当key不存在时，调用此方法获取key值，并加入缓存
  */
 func (this *Bcache) LoaderFunc(loader BcacheLoaderFunc) *Bcache {
-	this.load = func(key string) (string, error) {
+	this.load = func(ctx context.Context, key string) (string, error) {
 		v, err := loader(key)
 		return v, err
 	}
 	return this
 }
 
+/**
+ * 同LoaderFunc，载入函数的ctx在LoadTimeout后取消，不随调用方取消
+ */
+func (this *Bcache) LoaderFuncContext(loader BcacheLoaderContextFunc) *Bcache {
+	this.load = loader
+	return this
+}
+
+/**
+ * 设置载入函数的超时时间
+ */
+func (this *Bcache) LoadTimeout(timeout time.Duration) *Bcache {
+	this.loadTo = timeout
+	return this
+}
+
 /**
  * 为每一个key设置默认过期时间
  */
@@ -70,12 +124,115 @@ func (this *Bcache) Ttl(ttl time.Duration) *Bcache {
 }
 
 /**
- * 设置缓存
+ * 设置内存上限，Set后超过上限时从链表尾部淘汰
+ */
+func (this *Bcache) MaxMem(bytes int) *Bcache {
+	this.maxMem = bytes
+	return this
+}
+
+/**
+ * 设置单个value的大小上限，超过上限的Set被拒绝
+ */
+func (this *Bcache) MaxValueSize(bytes int) *Bcache {
+	this.maxVal = bytes
+	return this
+}
+
+func itemMem(key string, value string) int {
+	return len(key) + len(value) + BCACHE_ITEM_OVERHEAD
+}
+
+/**
+ * 启动后台清理，每interval随机检查sample个成员并删除过期的，sample<=0时使用BCACHE_JANITOR_SAMPLE
+ */
+func (this *Bcache) Janitor(interval time.Duration, sample int) *Bcache {
+	if this.stop != nil {
+		return this
+	}
+	if sample <= 0 {
+		sample = BCACHE_JANITOR_SAMPLE
+	}
+	this.stop = make(chan struct{})
+	go this.janitor(interval, sample, this.stop)
+	return this
+}
+
+/**
+ * 停止后台清理，缓存仍可继续使用
+ */
+func (this *Bcache) Close() {
+	this.once.Do(func() {
+		if this.stop != nil {
+			close(this.stop)
+		}
+	})
+}
+
+func (this *Bcache) janitor(interval time.Duration, sample int, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for i := 0; i < BCACHE_JANITOR_ROUNDS; i++ {
+				checked, expired := this.sweep(sample)
+				if checked < sample || float64(expired) <= float64(checked)*BCACHE_JANITOR_RATIO {
+					break
+				}
+			}
+		}
+	}
+}
+
+/**
+ * 检查最多sample个成员，删除其中过期的，返回检查与删除的个数
+ * map的遍历起点是随机的，取遍历的前sample个作为随机采样
+ */
+func (this *Bcache) sweep(sample int) (int, int) {
+	checked, expired := 0, 0
+	now := time.Now()
+	this.mu.Lock()
+	for _, item := range this.data {
+		if checked >= sample {
+			break
+		}
+		checked++
+		it := item.Value.(*cItem)
+		if it.expire != nil && it.expire.Before(now) {
+			this.removeItem(item)
+			expired++
+		}
+	}
+	this.mu.Unlock()
+	atomic.AddInt32(&this.swept, int32(expired))
+	return checked, expired
+}
+
+/**
+ * 设置缓存，超过大小上限时返回false，并删除该key的旧值，避免读到过期的数据
  */
 func (this *Bcache) Set(key string, value string) bool {
 	this.mu.Lock()
+	if call, ok := this.calls[key]; ok {
+		call.dirty = true
+	}
+	ok := this.set(key, value)
+	this.mu.Unlock()
+	return ok
+}
 
-	mem := len([]byte(value))
+func (this *Bcache) set(key string, value string) bool {
+	mem := itemMem(key, value)
+	if (this.maxVal > 0 && len(value) > this.maxVal) || (this.maxMem > 0 && mem > this.maxMem) {
+		if item, ok := this.data[key]; ok {
+			this.removeItem(item)
+		}
+		atomic.AddInt32(&this.reject, 1)
+		return false
+	}
 	//check existing
 	if item, ok := this.data[key]; ok {
 		this.items.MoveToFront(item)
@@ -101,8 +258,11 @@ func (this *Bcache) Set(key string, value string) bool {
 
 		this.mem = this.mem + mem
 	}
+	//新成员在链表头部，不会被淘汰
+	for this.maxMem > 0 && this.mem > this.maxMem && this.items.Len() > 1 {
+		this.delLast(1)
+	}
 
-	this.mu.Unlock()
 	return true
 }
 
@@ -110,6 +270,14 @@ func (this *Bcache) Set(key string, value string) bool {
  * 获取指定key的value
  */
 func (this *Bcache) Get(key string) (string, error) {
+	return this.GetContext(context.Background(), key)
+}
+
+/**
+ * 获取指定key的value，未命中时同一key只有一个载入在进行，
+ * ctx取消时调用方返回ctx.Err()，载入继续进行，结果供其他调用方使用
+ */
+func (this *Bcache) GetContext(ctx context.Context, key string) (string, error) {
 	this.mu.Lock()
 	item, ok := this.data[key]
 	if ok {
@@ -124,27 +292,85 @@ func (this *Bcache) Get(key string) (string, error) {
 		}
 		this.removeItem(item)
 	}
-	this.mu.Unlock()
 	//增加统计 -- 未命中
 	atomic.AddInt32(&this.miss, 1)
-	if this.load != nil {
-		v, err := this.load(key)
-		if err == nil {
-			this.Set(key, v)
-			return v, nil
+	if this.load == nil {
+		this.mu.Unlock()
+		return "", BcacheKeyNotFound
+	}
+	call, ok := this.calls[key]
+	if !ok {
+		call = &loadCall{done: make(chan struct{})}
+		this.calls[key] = call
+		go this.doLoad(key, call)
+	}
+	this.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+/**
+ * 调用载入函数并写入缓存，载入使用独立的ctx，不受单个调用方取消的影响
+ * 载入在单独的goroutine中进行，panic转为错误返回给等待的调用方
+ */
+func (this *Bcache) doLoad(key string, call *loadCall) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = "", fmt.Errorf("bcache %s load %s panic: %v", this.name, key, r)
 		}
-		return "", err
+		this.mu.Lock()
+		if call.err == nil && !call.dirty {
+			this.set(key, call.value)
+		}
+		delete(this.calls, key)
+		this.mu.Unlock()
+		close(call.done)
+	}()
+
+	ctx := context.Background()
+	if this.loadTo > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.loadTo)
+		defer cancel()
 	}
-	return "", BcacheKeyNotFound
+	call.value, call.err = this.load(ctx, key)
 }
 
 /**
- * 返回所有的key信息
+ * 获取指定key的value，不存在时不调用载入函数，用于批量获取时先挑出未缓存的key
+ */
+func (this *Bcache) Peek(key string) (string, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	item, ok := this.data[key]
+	if !ok {
+		return "", false
+	}
+	it := item.Value.(*cItem)
+	if it.IsExpired() {
+		this.removeItem(item)
+		return "", false
+	}
+	this.items.MoveToFront(item)
+	atomic.AddInt32(&this.hit, 1)
+	return it.value, true
+}
+
+/**
+ * 返回所有未过期的key信息
  */
 func (this *Bcache) Keys() []string {
 	var member []string
 	this.mu.RLock()
-	for key, _ := range this.data {
+	for key, item := range this.data {
+		if item.Value.(*cItem).IsExpired() {
+			continue
+		}
 		member = append(member, key)
 	}
 	this.mu.RUnlock()
@@ -160,6 +386,9 @@ func (this *Bcache) Del(key string) bool {
 
 func (this *Bcache) del(key string) bool {
 	this.mu.Lock()
+	if call, ok := this.calls[key]; ok {
+		call.dirty = true
+	}
 	if item, ok := this.data[key]; ok {
 		this.removeItem(item)
 	}
@@ -189,13 +418,20 @@ func (this *Bcache) del(key string) bool {
 // }
 
 /**
- * 返回状态
+ * 返回状态，mem_usage为内存占上限的比例，不限制内存时为0
  */
 func (this *Bcache) Stat() map[string]interface{} {
 	this.mu.RLock()
 	var stat = map[string]interface{}{
-		"mem":  this.mem,
-		"size": len(this.data),
+		"mem":       this.mem,
+		"size":      len(this.data),
+		"max_mem":   this.maxMem,
+		"mem_usage": 0.0,
+		"reject":    atomic.LoadInt32(&this.reject),
+		"expired":   atomic.LoadInt32(&this.swept),
+	}
+	if this.maxMem > 0 {
+		stat["mem_usage"] = float64(this.mem) / float64(this.maxMem)
 	}
 	this.mu.RUnlock()
 	return stat
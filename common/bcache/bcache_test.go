@@ -0,0 +1,627 @@
+package bcache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	benchKeys   = 10000
+	benchShards = 16
+)
+
+type benchCache interface {
+	Get(key string) (string, error)
+	Set(key string, value string) bool
+}
+
+var benchKeyList = func() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "content_info|" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+func newBenchBcache() benchCache {
+	c := NewBcache("bench", benchKeys*2).Ttl(time.Minute)
+	for _, key := range benchKeyList {
+		c.Set(key, key)
+	}
+	return c
+}
+
+func newBenchShardedBcache() benchCache {
+	c := NewShardedBcache("bench", benchKeys*2, benchShards).Ttl(time.Minute)
+	for _, key := range benchKeyList {
+		c.Set(key, key)
+	}
+	return c
+}
+
+// benchmarkCache 并发读写，每writeEvery次操作中有一次Set，writeEvery为0时只读
+func benchmarkCache(b *testing.B, c benchCache, writeEvery int) {
+	var seq int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// 各goroutine从不同的位置开始，避免同时访问同一个key
+		i := int(atomic.AddInt32(&seq, 1)) * 997
+		for pb.Next() {
+			key := benchKeyList[i%benchKeys]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				c.Set(key, key)
+			} else if _, err := c.Get(key); err != nil {
+				b.Fatal(err)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkBcacheGet(b *testing.B) {
+	benchmarkCache(b, newBenchBcache(), 0)
+}
+
+func BenchmarkShardedBcacheGet(b *testing.B) {
+	benchmarkCache(b, newBenchShardedBcache(), 0)
+}
+
+func BenchmarkBcacheGetSet(b *testing.B) {
+	benchmarkCache(b, newBenchBcache(), 10)
+}
+
+func BenchmarkShardedBcacheGetSet(b *testing.B) {
+	benchmarkCache(b, newBenchShardedBcache(), 10)
+}
+
+func TestBcacheMaxMem(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	per := itemMem("k0", value)
+	cases := []struct {
+		name   string
+		maxMem int
+		sets   int
+		want   int
+	}{
+		{"unlimited", 0, 10, 10},
+		{"under budget", per * 10, 10, 10},
+		{"evict from tail", per * 3, 10, 3},
+		{"budget for one item", per, 10, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 100).MaxMem(tc.maxMem)
+			for i := 0; i < tc.sets; i++ {
+				if !c.Set("k"+strconv.Itoa(i), value) {
+					t.Fatalf("Set k%d rejected", i)
+				}
+			}
+			if n := len(c.Keys()); n != tc.want {
+				t.Fatalf("len(Keys()) = %d, want %d", n, tc.want)
+			}
+			// 留下的是最近写入的
+			for i := tc.sets - tc.want; i < tc.sets; i++ {
+				if _, ok := c.Peek("k" + strconv.Itoa(i)); !ok {
+					t.Errorf("k%d evicted", i)
+				}
+			}
+			stat := c.Stat()
+			if stat["mem"] != per*tc.want {
+				t.Errorf("mem = %v, want %d", stat["mem"], per*tc.want)
+			}
+			if stat["max_mem"] != tc.maxMem {
+				t.Errorf("max_mem = %v, want %d", stat["max_mem"], tc.maxMem)
+			}
+		})
+	}
+}
+
+func TestBcacheMaxMemLRU(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	c := NewBcache("test", 100).MaxMem(itemMem("k0", value) * 3)
+	c.Set("k0", value)
+	c.Set("k1", value)
+	c.Set("k2", value)
+	// 访问k0后k1成为最久未使用
+	if _, err := c.Get("k0"); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("k3", value)
+	if _, ok := c.Peek("k1"); ok {
+		t.Error("k1 should be evicted")
+	}
+	for _, key := range []string{"k0", "k2", "k3"} {
+		if _, ok := c.Peek(key); !ok {
+			t.Errorf("%s evicted", key)
+		}
+	}
+}
+
+func TestBcacheMaxValueSize(t *testing.T) {
+	cases := []struct {
+		name     string
+		maxMem   int
+		maxValue int
+		size     int
+		want     bool
+	}{
+		{"unlimited", 0, 0, 1 << 20, true},
+		{"equal to max value size", 0, 100, 100, true},
+		{"larger than max value size", 0, 100, 101, false},
+		{"larger than max mem", itemMem("key", "") + 50, 0, 51, false},
+		{"fits max mem", itemMem("key", "") + 50, 0, 50, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 100).MaxMem(tc.maxMem).MaxValueSize(tc.maxValue)
+			c.Set("key", "old")
+			if ok := c.Set("key", strings.Repeat("v", tc.size)); ok != tc.want {
+				t.Fatalf("Set = %v, want %v", ok, tc.want)
+			}
+			v, ok := c.Peek("key")
+			if tc.want && (!ok || len(v) != tc.size) {
+				t.Errorf("value not stored")
+			}
+			// 被拒绝时旧值也被删除，避免读到过期的数据
+			if !tc.want && ok {
+				t.Errorf("old value %q kept after reject", v)
+			}
+			reject := int32(0)
+			if !tc.want {
+				reject = 1
+			}
+			if stat := c.Stat(); stat["reject"] != reject {
+				t.Errorf("reject = %v, want %d", stat["reject"], reject)
+			}
+		})
+	}
+}
+
+func TestBcacheStatMemUsage(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	per := itemMem("k0", value)
+	cases := []struct {
+		name   string
+		maxMem int
+		sets   int
+		want   float64
+	}{
+		{"unlimited", 0, 2, 0},
+		{"empty", per * 4, 0, 0},
+		{"half", per * 4, 2, 0.5},
+		{"full", per * 4, 6, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 100).MaxMem(tc.maxMem)
+			for i := 0; i < tc.sets; i++ {
+				c.Set("k"+strconv.Itoa(i), value)
+			}
+			if usage := c.Stat()["mem_usage"]; usage != tc.want {
+				t.Errorf("mem_usage = %v, want %v", usage, tc.want)
+			}
+		})
+	}
+}
+
+func TestBcacheSingleflight(t *testing.T) {
+	cases := []struct {
+		name    string
+		callers int
+		value   string
+		err     error
+	}{
+		{"one caller", 1, "v", nil},
+		{"concurrent callers share value", 50, "v", nil},
+		{"concurrent callers share error", 50, "", errors.New("load failed")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			c := NewBcache("test", 100).LoaderFunc(func(key string) (string, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return tc.value, tc.err
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < tc.callers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					v, err := c.Get("key")
+					if v != tc.value || err != tc.err {
+						t.Errorf("Get = %q, %v, want %q, %v", v, err, tc.value, tc.err)
+					}
+				}()
+			}
+			// 等所有调用方都在等待同一次载入后再返回
+			waitFor(t, func() bool { return atomic.LoadInt32(&c.miss) == int32(tc.callers) })
+			close(release)
+			wg.Wait()
+
+			if calls != 1 {
+				t.Errorf("loader called %d times, want 1", calls)
+			}
+			_, cached := c.Peek("key")
+			if cached != (tc.err == nil) {
+				t.Errorf("cached = %v, want %v", cached, tc.err == nil)
+			}
+		})
+	}
+}
+
+func TestBcacheGetContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	loadErr := make(chan error, 1)
+	c := NewBcache("test", 100).LoaderFuncContext(func(ctx context.Context, key string) (string, error) {
+		<-release
+		loadErr <- ctx.Err()
+		return "v", nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.GetContext(ctx, "key")
+		done <- err
+	}()
+	waitFor(t, func() bool { return atomic.LoadInt32(&c.miss) == 1 })
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("GetContext = %v, want %v", err, context.Canceled)
+	}
+
+	// 调用方放弃后载入继续进行，结果写入缓存
+	close(release)
+	if err := <-loadErr; err != nil {
+		t.Errorf("load ctx err = %v, want nil", err)
+	}
+	waitFor(t, func() bool {
+		_, ok := c.Peek("key")
+		return ok
+	})
+}
+
+func TestBcacheLoadTimeout(t *testing.T) {
+	c := NewBcache("test", 100).LoaderFuncContext(func(ctx context.Context, key string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}).LoadTimeout(10 * time.Millisecond)
+	if _, err := c.Get("key"); err != context.DeadlineExceeded {
+		t.Fatalf("Get = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBcacheLoaderPanic(t *testing.T) {
+	c := NewBcache("test", 100).LoaderFunc(func(key string) (string, error) {
+		panic("boom")
+	})
+	_, err := c.Get("key")
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Get = %v, want panic error", err)
+	}
+	// 下一次Get重新载入，而不是一直等待
+	if _, err := c.Get("key"); err == nil {
+		t.Fatal("second Get should also fail")
+	}
+}
+
+func TestBcacheLoadDirty(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(c *Bcache)
+		want   string
+		cached bool
+	}{
+		{"no change", func(c *Bcache) {}, "loaded", true},
+		{"del during load", func(c *Bcache) { c.Del("key") }, "", false},
+		{"set during load", func(c *Bcache) { c.Set("key", "new") }, "new", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			c := NewBcache("test", 100).LoaderFunc(func(key string) (string, error) {
+				<-release
+				return "loaded", nil
+			})
+			done := make(chan struct{})
+			go func() {
+				c.Get("key")
+				close(done)
+			}()
+			waitFor(t, func() bool { return atomic.LoadInt32(&c.miss) == 1 })
+			tc.change(c)
+			close(release)
+			<-done
+
+			// 载入期间被Set或Del时载入结果不写回缓存
+			v, ok := c.Peek("key")
+			if ok != tc.cached || v != tc.want {
+				t.Errorf("Peek = %q, %v, want %q, %v", v, ok, tc.want, tc.cached)
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBcacheJanitor(t *testing.T) {
+	cases := []struct {
+		name    string
+		expired int
+		live    int
+	}{
+		{"all expired", 200, 0},
+		{"mostly live", 20, 200},
+		{"mixed", 100, 100},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 1000).Janitor(5*time.Millisecond, 0)
+			defer c.Close()
+			for i := 0; i < tc.expired; i++ {
+				key := "expired" + strconv.Itoa(i)
+				c.Set(key, "v")
+				c.Expire(key, -time.Second)
+			}
+			for i := 0; i < tc.live; i++ {
+				c.Set("live"+strconv.Itoa(i), "v")
+			}
+
+			// 后台清理不经过Get也能删除过期的成员
+			waitFor(t, func() bool { return c.Stat()["size"] == tc.live })
+			if swept := c.Stat()["expired"]; swept != int32(tc.expired) {
+				t.Errorf("expired = %v, want %d", swept, tc.expired)
+			}
+		})
+	}
+}
+
+func TestBcacheClose(t *testing.T) {
+	cases := []struct {
+		name    string
+		janitor bool
+	}{
+		{"without janitor", false},
+		{"with janitor", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 100)
+			if tc.janitor {
+				c.Janitor(time.Millisecond, 0)
+			}
+			c.Close()
+			c.Close()
+
+			// 停止清理后缓存仍可使用，过期成员不再被后台删除
+			c.Set("key", "v")
+			c.Expire("key", -time.Second)
+			time.Sleep(10 * time.Millisecond)
+			if size := c.Stat()["size"]; size != 1 {
+				t.Errorf("size = %v, want 1", size)
+			}
+		})
+	}
+}
+
+func TestBcacheKeysSkipExpired(t *testing.T) {
+	cases := []struct {
+		name    string
+		expired []string
+		live    []string
+	}{
+		{"none expired", nil, []string{"a", "b"}},
+		{"some expired", []string{"a"}, []string{"b", "c"}},
+		{"all expired", []string{"a", "b"}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewBcache("test", 100)
+			for _, key := range tc.expired {
+				c.Set(key, "v")
+				c.Expire(key, -time.Second)
+			}
+			for _, key := range tc.live {
+				c.Set(key, "v")
+			}
+			keys := c.Keys()
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(tc.live, ",") {
+				t.Errorf("Keys() = %v, want %v", keys, tc.live)
+			}
+		})
+	}
+}
+
+func TestShardedBcacheSplit(t *testing.T) {
+	cases := []struct {
+		name       string
+		length     int
+		shards     int
+		maxMem     int
+		wantShards int
+		wantSize   int
+		wantMaxMem int
+	}{
+		{"even", 100, 4, 1000, 4, 25, 250},
+		{"round up", 10, 3, 100, 3, 4, 34},
+		{"more shards than length", 3, 8, 0, 8, 1, 0},
+		{"no shards", 5, 0, 50, 1, 5, 50},
+		{"unlimited mem", 100, 4, 0, 4, 25, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewShardedBcache("test", tc.length, tc.shards).MaxMem(tc.maxMem)
+			if len(c.shards) != tc.wantShards {
+				t.Fatalf("shards = %d, want %d", len(c.shards), tc.wantShards)
+			}
+			for i, s := range c.shards {
+				if s.size != tc.wantSize {
+					t.Errorf("shard %d size = %d, want %d", i, s.size, tc.wantSize)
+				}
+				if s.maxMem != tc.wantMaxMem {
+					t.Errorf("shard %d maxMem = %d, want %d", i, s.maxMem, tc.wantMaxMem)
+				}
+			}
+		})
+	}
+}
+
+// shardKeys 返回n个落在第idx段的key
+func shardKeys(c *ShardedBcache, idx, n int) []string {
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		key := "k" + strconv.Itoa(i)
+		if c.shard(key) == c.shards[idx] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestShardedBcacheShardLimit(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	cases := []struct {
+		name   string
+		length int
+		maxMem int
+	}{
+		// 每段2个成员
+		{"size", 4, 0},
+		// 每段的内存只够2个成员
+		{"max mem", 100, itemMem("k0", value) * 2 * 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewShardedBcache("test", tc.length, 2).MaxMem(tc.maxMem)
+			other := shardKeys(c, 1, 1)[0]
+			c.Set(other, value)
+			keys := shardKeys(c, 0, 3)
+			for _, key := range keys {
+				c.Set(key, value)
+			}
+			// 淘汰只在所在的段内进行
+			if _, ok := c.Peek(keys[0]); ok {
+				t.Errorf("%s should be evicted", keys[0])
+			}
+			for _, key := range []string{keys[1], keys[2], other} {
+				if _, ok := c.Peek(key); !ok {
+					t.Errorf("%s evicted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedBcacheKeys(t *testing.T) {
+	cases := []struct {
+		name    string
+		expired int
+		live    int
+	}{
+		{"empty", 0, 0},
+		{"none expired", 0, 20},
+		{"some expired", 5, 20},
+		{"all expired", 20, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewShardedBcache("test", 100, 4)
+			for i := 0; i < tc.expired; i++ {
+				key := "expired" + strconv.Itoa(i)
+				c.Set(key, "v")
+				c.Expire(key, -time.Second)
+			}
+			var want []string
+			used := make(map[*Bcache]bool)
+			for i := 0; i < tc.live; i++ {
+				key := "live" + strconv.Itoa(i)
+				c.Set(key, "v")
+				want = append(want, key)
+				used[c.shard(key)] = true
+			}
+			if tc.live > 0 && len(used) < 2 {
+				t.Fatalf("keys not spread across shards")
+			}
+			keys := c.Keys()
+			sort.Strings(keys)
+			sort.Strings(want)
+			if strings.Join(keys, ",") != strings.Join(want, ",") {
+				t.Errorf("Keys() = %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+func TestShardedBcacheStat(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	per := itemMem("k0", value)
+	cases := []struct {
+		name      string
+		maxMem    int
+		sets      int
+		expired   int
+		large     int
+		wantUsage float64
+	}{
+		{"unlimited", 0, 8, 0, 0, 0},
+		{"limited", per * 40, 8, 0, 0, float64(per*8) / float64(per*40)},
+		{"expired", 0, 8, 3, 0, 0},
+		// 大于每段内存上限的value被拒绝
+		{"reject", per * 40, 8, 0, 2, float64(per*8) / float64(per*40)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewShardedBcache("test", 100, 4).MaxMem(tc.maxMem)
+			for i := 0; i < tc.sets; i++ {
+				c.Set("k"+strconv.Itoa(i), value)
+			}
+			for i := 0; i < tc.large; i++ {
+				c.Set("large"+strconv.Itoa(i), strings.Repeat("v", tc.maxMem))
+			}
+			for i := 0; i < tc.expired; i++ {
+				c.Expire("k"+strconv.Itoa(i), -time.Second)
+			}
+			for _, s := range c.shards {
+				s.sweep(100)
+			}
+
+			stat := c.Stat()
+			size := tc.sets - tc.expired
+			want := map[string]interface{}{
+				"mem":       per * size,
+				"size":      size,
+				"max_mem":   tc.maxMem,
+				"mem_usage": tc.wantUsage,
+				"reject":    int32(tc.large),
+				"expired":   int32(tc.expired),
+				"shards":    4,
+			}
+			for key, value := range want {
+				if stat[key] != value {
+					t.Errorf("%s = %v, want %v", key, stat[key], value)
+				}
+			}
+		})
+	}
+}
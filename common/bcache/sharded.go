@@ -0,0 +1,179 @@
+package bcache
+
+/**
+ * 分段LRU
+ * key按hash分到多个独立的Bcache，Get时只锁所在的段，减少锁竞争。
+ * 成员数量与内存上限按段平均分配，淘汰在段内进行，整体上为近似LRU；
+ * 单个value还需要小于每段的内存上限。
+ * example:
+ * cache := bcache.NewShardedBcache("test_cache",1024,16).Ttl(120*time.Second).LoaderFunc(loader)
+ * cache.Get("test1")
+ */
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type ShardedBcache struct {
+	name   string    //缓存名
+	shards []*Bcache //各段
+}
+
+func NewShardedBcache(name string, lenght int, shards int) *ShardedBcache {
+	if shards <= 0 {
+		shards = 1
+	}
+	c := &ShardedBcache{
+		name:   name,
+		shards: make([]*Bcache, shards),
+	}
+	size := (lenght + shards - 1) / shards
+	for i := range c.shards {
+		c.shards[i] = NewBcache(fmt.Sprintf("%s_%d", name, i), size)
+	}
+	return c
+}
+
+/**
+ * fnv-1a，避免hash.Hash32的内存分配
+ */
+func (this *ShardedBcache) shard(key string) *Bcache {
+	if len(this.shards) == 1 {
+		return this.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return this.shards[h%uint32(len(this.shards))]
+}
+
+func (this *ShardedBcache) LoaderFunc(loader BcacheLoaderFunc) *ShardedBcache {
+	for _, s := range this.shards {
+		s.LoaderFunc(loader)
+	}
+	return this
+}
+
+func (this *ShardedBcache) LoaderFuncContext(loader BcacheLoaderContextFunc) *ShardedBcache {
+	for _, s := range this.shards {
+		s.LoaderFuncContext(loader)
+	}
+	return this
+}
+
+func (this *ShardedBcache) LoadTimeout(timeout time.Duration) *ShardedBcache {
+	for _, s := range this.shards {
+		s.LoadTimeout(timeout)
+	}
+	return this
+}
+
+func (this *ShardedBcache) Ttl(ttl time.Duration) *ShardedBcache {
+	for _, s := range this.shards {
+		s.Ttl(ttl)
+	}
+	return this
+}
+
+/**
+ * 内存上限按段平均分配
+ */
+func (this *ShardedBcache) MaxMem(bytes int) *ShardedBcache {
+	per := 0
+	if bytes > 0 {
+		per = (bytes + len(this.shards) - 1) / len(this.shards)
+	}
+	for _, s := range this.shards {
+		s.MaxMem(per)
+	}
+	return this
+}
+
+func (this *ShardedBcache) MaxValueSize(bytes int) *ShardedBcache {
+	for _, s := range this.shards {
+		s.MaxValueSize(bytes)
+	}
+	return this
+}
+
+/**
+ * 每段各自后台清理
+ */
+func (this *ShardedBcache) Janitor(interval time.Duration, sample int) *ShardedBcache {
+	for _, s := range this.shards {
+		s.Janitor(interval, sample)
+	}
+	return this
+}
+
+func (this *ShardedBcache) Close() {
+	for _, s := range this.shards {
+		s.Close()
+	}
+}
+
+func (this *ShardedBcache) Set(key string, value string) bool {
+	return this.shard(key).Set(key, value)
+}
+
+func (this *ShardedBcache) Get(key string) (string, error) {
+	return this.shard(key).Get(key)
+}
+
+func (this *ShardedBcache) GetContext(ctx context.Context, key string) (string, error) {
+	return this.shard(key).GetContext(ctx, key)
+}
+
+func (this *ShardedBcache) Peek(key string) (string, bool) {
+	return this.shard(key).Peek(key)
+}
+
+func (this *ShardedBcache) Del(key string) bool {
+	return this.shard(key).Del(key)
+}
+
+func (this *ShardedBcache) Expire(key string, expiration time.Duration) bool {
+	return this.shard(key).Expire(key, expiration)
+}
+
+func (this *ShardedBcache) Keys() []string {
+	var member []string
+	for _, s := range this.shards {
+		member = append(member, s.Keys()...)
+	}
+	return member
+}
+
+/**
+ * 返回各段汇总后的状态，各段分别加锁，结果不是同一时刻的快照
+ */
+func (this *ShardedBcache) Stat() map[string]interface{} {
+	var mem, size, maxMem int
+	var reject, expired int32
+	for _, s := range this.shards {
+		s.mu.RLock()
+		mem += s.mem
+		size += len(s.data)
+		maxMem += s.maxMem
+		s.mu.RUnlock()
+		reject += atomic.LoadInt32(&s.reject)
+		expired += atomic.LoadInt32(&s.swept)
+	}
+	var stat = map[string]interface{}{
+		"mem":       mem,
+		"size":      size,
+		"max_mem":   maxMem,
+		"mem_usage": 0.0,
+		"reject":    reject,
+		"expired":   expired,
+		"shards":    len(this.shards),
+	}
+	if maxMem > 0 {
+		stat["mem_usage"] = float64(mem) / float64(maxMem)
+	}
+	return stat
+}
@@ -1,7 +1,10 @@
 package common
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strings"
 )
@@ -18,6 +21,23 @@ func CheckSign(sign, source, t string, ibiz int) bool {
 	return false
 }
 
+// CheckHmacSign 带密钥的签名，sign为hmac-sha256(secret, source|ibiz|t|hex(sha256(body)))的hex，
+// body为原始的请求内容，签名只对同一个请求有效；secret为空时总是失败
+func CheckHmacSign(sign, secret, source, t string, ibiz int, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s|%d|%s|%x", source, ibiz, t, sha256.Sum256(body))))
+	expected := mac.Sum(nil)
+
+	got, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, expected)
+}
+
 func ParseStringToInterface(str string) []interface{} {
 	res := make([]interface{}, 0)
 
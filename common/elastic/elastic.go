@@ -54,6 +54,9 @@ package elastic
 
 import (
 	"encoding/json"
+	"path"
+	"sort"
+	"strings"
 
 	elastic "gopkg.in/olivere/elastic.v6"
 )
@@ -92,18 +95,141 @@ func New(conf ElasticConf) (*ElasticClient, error) {
 	return e, nil
 }
 
+// ParseDoc 按fields从source中提取字段
+// 支持author.name形式的嵌套字段与com_*形式的通配符，输出保留source中的嵌套结构
 func (c *ElasticClient) ParseDoc(source *json.RawMessage, fields []string) (map[string]interface{}, error) {
 	res := make(map[string]interface{})
+	if source == nil {
+		return res, nil
+	}
 
 	var jdata map[string]interface{}
 	err := json.Unmarshal(*source, &jdata)
 	if err != nil {
-		return res, nil
+		return res, err
 	}
 
 	for _, field := range fields {
-		res[field], _ = jdata[field]
+		values := ResolveField(jdata, field)
+		if len(values) == 0 && !strings.ContainsAny(field, ".*") {
+			// 与之前保持一致，不存在的顶层字段输出null
+			res[field] = nil
+			continue
+		}
+		for _, v := range values {
+			pickValue(res, jdata, v.Path, v.Value)
+		}
 	}
 
 	return res, nil
 }
+
+// NewFetchSourceContext 将fields下推给es做_source过滤，fields为空时不返回_source
+func NewFetchSourceContext(fields []string) *elastic.FetchSourceContext {
+	if len(fields) == 0 {
+		return elastic.NewFetchSourceContext(false)
+	}
+	return elastic.NewFetchSourceContext(true).Include(fields...)
+}
+
+// FieldValue 字段路径匹配到的一个值
+// Path为值在source中的位置，string为对象的key，int为对象数组的下标；Parent[Name]即该值，可用于原地修改
+type FieldValue struct {
+	Path   []interface{}
+	Parent map[string]interface{}
+	Name   string
+	Value  interface{}
+}
+
+// ResolveField 按es的_source过滤的规则解析author.name、com_*、author.*形式的字段，返回所有存在的值
+// 每一层先尝试剩余各段拼成的字面带点的key，如{"author.name": ...}，再按.拆开进入子对象，子对象为数组时进入其中的每个对象
+func ResolveField(src map[string]interface{}, field string) []FieldValue {
+	var values []FieldValue
+	resolveField(src, strings.Split(field, "."), nil, &values)
+	return values
+}
+
+func resolveField(src map[string]interface{}, keys []string, prefix []interface{}, values *[]FieldValue) {
+	for i := len(keys); i > 0; i-- {
+		rest := keys[i:]
+		for _, name := range matchNames(src, strings.Join(keys[:i], ".")) {
+			value := src[name]
+			at := appendPath(prefix, name)
+			if len(rest) == 0 {
+				*values = append(*values, FieldValue{Path: at, Parent: src, Name: name, Value: value})
+				continue
+			}
+
+			switch v := value.(type) {
+			case map[string]interface{}:
+				resolveField(v, rest, at, values)
+			case []interface{}:
+				for idx, elem := range v {
+					if obj, ok := elem.(map[string]interface{}); ok {
+						resolveField(obj, rest, appendPath(at, idx), values)
+					}
+				}
+			}
+		}
+	}
+}
+
+// matchNames src中与pattern匹配的key，按名字排序使输出稳定
+func matchNames(src map[string]interface{}, pattern string) []string {
+	if !strings.Contains(pattern, "*") {
+		if _, ok := src[pattern]; ok {
+			return []string{pattern}
+		}
+		return nil
+	}
+
+	var names []string
+	for name := range src {
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func appendPath(prefix []interface{}, step interface{}) []interface{} {
+	at := make([]interface{}, len(prefix), len(prefix)+1)
+	copy(at, prefix)
+	return append(at, step)
+}
+
+// pickValue 按path把value写入dst，保留source中的嵌套结构
+// 对象数组按下标合并，多个字段取自同一数组时落在同一个元素里
+func pickValue(dst, src map[string]interface{}, at []interface{}, value interface{}) {
+	name := at[0].(string)
+	if len(at) == 1 {
+		dst[name] = value
+		return
+	}
+
+	if idx, ok := at[1].(int); ok {
+		elems, _ := src[name].([]interface{})
+		arr, ok := dst[name].([]interface{})
+		if !ok || len(arr) != len(elems) {
+			arr = make([]interface{}, len(elems))
+			dst[name] = arr
+		}
+		sub, ok := arr[idx].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			arr[idx] = sub
+		}
+		obj, _ := elems[idx].(map[string]interface{})
+		pickValue(sub, obj, at[2:], value)
+		return
+	}
+
+	sub, ok := dst[name].(map[string]interface{})
+	if !ok {
+		sub = make(map[string]interface{})
+		dst[name] = sub
+	}
+	obj, _ := src[name].(map[string]interface{})
+	pickValue(sub, obj, at[1:], value)
+}
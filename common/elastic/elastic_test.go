@@ -0,0 +1,115 @@
+package elastic
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSource = `{
+	"title": "hello",
+	"com_biz": 160,
+	"com_type": 1,
+	"author": {"name": "tony", "phone": "13812345678"},
+	"author.email": "tony@example.com",
+	"meta.info": {"lang": "zh"},
+	"tags": [{"name": "a", "id": 1}, "raw", {"name": "b"}],
+	"score": 3.5
+}`
+
+func testDoc(t *testing.T) map[string]interface{} {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(testSource), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestResolveField(t *testing.T) {
+	cases := []struct {
+		field  string
+		paths  [][]interface{}
+		values []interface{}
+	}{
+		{"title", [][]interface{}{{"title"}}, []interface{}{"hello"}},
+		{"missing", nil, nil},
+		{"author.name", [][]interface{}{{"author", "name"}}, []interface{}{"tony"}},
+		// 字面带点的key
+		{"author.email", [][]interface{}{{"author.email"}}, []interface{}{"tony@example.com"}},
+		{"meta.info.lang", [][]interface{}{{"meta.info", "lang"}}, []interface{}{"zh"}},
+		// 通配符同时匹配子对象与字面带点的key，按名字排序
+		{"author.*", [][]interface{}{{"author.email"}, {"author", "name"}, {"author", "phone"}},
+			[]interface{}{"tony@example.com", "tony", "13812345678"}},
+		{"com_*", [][]interface{}{{"com_biz"}, {"com_type"}}, []interface{}{float64(160), float64(1)}},
+		// 数组中的对象按下标，非对象的元素与不存在的叶子跳过
+		{"tags.name", [][]interface{}{{"tags", 0, "name"}, {"tags", 2, "name"}}, []interface{}{"a", "b"}},
+		{"tags.id", [][]interface{}{{"tags", 0, "id"}}, []interface{}{float64(1)}},
+		// 中间的值不是对象
+		{"title.sub", nil, nil},
+		{"score.value", nil, nil},
+	}
+
+	for _, c := range cases {
+		values := ResolveField(testDoc(t), c.field)
+		if len(values) != len(c.paths) {
+			t.Errorf("%s: got %d values, want %d", c.field, len(values), len(c.paths))
+			continue
+		}
+		for i, v := range values {
+			if !reflect.DeepEqual(v.Path, c.paths[i]) {
+				t.Errorf("%s: path[%d] = %v, want %v", c.field, i, v.Path, c.paths[i])
+			}
+			if !reflect.DeepEqual(v.Value, c.values[i]) {
+				t.Errorf("%s: value[%d] = %v, want %v", c.field, i, v.Value, c.values[i])
+			}
+			if !reflect.DeepEqual(v.Parent[v.Name], v.Value) {
+				t.Errorf("%s: parent[%s] = %v, want %v", c.field, v.Name, v.Parent[v.Name], v.Value)
+			}
+		}
+	}
+}
+
+func TestResolveFieldParent(t *testing.T) {
+	doc := testDoc(t)
+	for _, v := range ResolveField(doc, "tags.name") {
+		v.Parent[v.Name] = "x"
+	}
+	tags := doc["tags"].([]interface{})
+	if tags[0].(map[string]interface{})["name"] != "x" || tags[2].(map[string]interface{})["name"] != "x" {
+		t.Errorf("tags not modified in place: %v", tags)
+	}
+}
+
+func TestParseDoc(t *testing.T) {
+	cases := []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"title"}, `{"title": "hello"}`},
+		// 不存在的顶层字段输出null，嵌套与通配符的不输出
+		{[]string{"missing", "author.missing", "nope_*"}, `{"missing": null}`},
+		{[]string{"author.name"}, `{"author": {"name": "tony"}}`},
+		{[]string{"author.email"}, `{"author.email": "tony@example.com"}`},
+		{[]string{"meta.info.lang"}, `{"meta.info": {"lang": "zh"}}`},
+		{[]string{"author.name", "author.phone"}, `{"author": {"name": "tony", "phone": "13812345678"}}`},
+		{[]string{"com_*"}, `{"com_biz": 160, "com_type": 1}`},
+		// 同一数组中的字段落在同一个元素里，没有取到的元素为null
+		{[]string{"tags.name", "tags.id"}, `{"tags": [{"name": "a", "id": 1}, null, {"name": "b"}]}`},
+		{[]string{"title.sub"}, `{}`},
+	}
+
+	source := json.RawMessage(testSource)
+	for _, c := range cases {
+		got, err := (&ElasticClient{}).ParseDoc(&source, c.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want map[string]interface{}
+		if err := json.Unmarshal([]byte(c.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", c.fields, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -51,7 +52,10 @@ var (
 	G_rc    map[string]*rc.Redis
 	G_mc    map[string]*mc.Mysql
 	G_ec    map[string]*ec.ElasticClient
-	G_cache map[string]*bc.Bcache
+	G_cache map[string]*bc.ShardedBcache
+
+	G_router *ContentRouter
+	G_acl    *ContentACLs
 
 	G_logger *log.Logger
 
@@ -68,6 +72,8 @@ func init() {
 
 	initLogger()
 
+	cursorSecret = loadCursorSecret()
+
 	// init redis
 	G_rc = make(map[string]*rc.Redis)
 	G_rc["wmp"], err = createRedisClient("redis_wmp")
@@ -84,15 +90,45 @@ func init() {
 
 	// init elastic
 	G_ec = make(map[string]*ec.ElasticClient)
-	G_ec["yxs"], err = createEsClient("elastic_yxs")
+	for _, name := range G_conf.DefaultStrings("content::esClusters", []string{"yxs"}) {
+		G_ec[name], err = createEsClient("elastic_" + name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// init content route
+	G_router = NewContentRouter()
+	err = G_router.Reload()
+	if err != nil {
+		panic(err)
+	}
+	go G_router.Refresh(time.Duration(G_conf.DefaultInt("content::routeRefresh", DEFAULT_ROUTE_REFRESH)) * time.Second)
+
+	// init content acl
+	G_acl = NewContentACLs()
+	err = G_acl.Reload()
 	if err != nil {
 		panic(err)
 	}
+	go G_acl.Refresh(time.Duration(G_conf.DefaultInt("content::aclRefresh", DEFAULT_ACL_REFRESH)) * time.Second)
 
 	// init bcache
-	G_cache = make(map[string]*bc.Bcache)
+	G_cache = make(map[string]*bc.ShardedBcache)
 	initBcache()
 
+	// init content sync
+	for _, name := range G_conf.Strings("content::syncJobs") {
+		if name == "" {
+			continue
+		}
+		syncer, err := NewContentSyncer(name)
+		if err != nil {
+			panic(err)
+		}
+		go syncer.Run()
+	}
+
 	G_rateLimit = common.NewTokenBucketLimiter(MAX_LIMIT_RATE)
 }
 
@@ -168,7 +204,32 @@ func createEsClient(name string) (*ec.ElasticClient, error) {
 }
 
 func initBcache() {
-	G_cache["content_base_info"] = bc.NewBcache("content_base_info", 1024*1024).Ttl(time.Second * 300)
+	G_cache["content_base_info"] = newBcache("content_base_info", 1024*1024).Ttl(time.Second * 300).LoaderFuncContext(loadContentBaseInfo).LoadTimeout(time.Second * 3)
+	G_cache["content_info"] = newBcache("content_info", 1024*100).Ttl(time.Second * 60)
+	G_cache["content_suggest"] = newBcache("content_suggest", 1024*10).Ttl(time.Second * 10)
+	G_cache["content_template"] = newBcache("content_template", 1024).Ttl(time.Second * 60).LoaderFuncContext(loadContentTemplate).LoadTimeout(time.Second * 3)
+}
+
+// newBcache 内存上限、单个值的上限与分段数来自[bcache]中同名的配置，格式为maxMem|maxValueSize[|shards]，
+// 未配置时不限制内存、不分段；过期的成员由后台每秒采样清理
+func newBcache(name string, size int) *bc.ShardedBcache {
+	parts := strings.Split(G_conf.String("bcache::"+name), "|")
+	shards := 1
+	if len(parts) > 2 {
+		if n, err := strconv.Atoi(parts[2]); err == nil && n > 0 {
+			shards = n
+		}
+	}
+	cache := bc.NewShardedBcache(name, size, shards).Janitor(time.Second, bc.BCACHE_JANITOR_SAMPLE)
+	if maxMem, err := strconv.Atoi(parts[0]); err == nil {
+		cache = cache.MaxMem(maxMem)
+	}
+	if len(parts) > 1 {
+		if maxValueSize, err := strconv.Atoi(parts[1]); err == nil {
+			cache = cache.MaxValueSize(maxValueSize)
+		}
+	}
+	return cache
 }
 
 func (c *AbstractController) Prepare() {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"strconv"
@@ -12,6 +13,8 @@ import (
 
 	"beego_framework/common"
 
+	ec "beego_framework/common/elastic"
+
 	elastic "gopkg.in/olivere/elastic.v6"
 )
 
@@ -38,12 +41,23 @@ type CCBasic struct {
 	Page      string `json:"page"`
 	Pagesize  string `json:"pagesize"`
 	Nc        string `json:"nc"`
+	Cursor    string `json:"cursor"`
+	Debug     string `json:"debug"`
 }
 
 type CCReqParam struct {
-	Basic   CCBasic   `json:"basic"`
-	Must    CCReqMust `json:"must"`
-	MustNot CCReqMust `json:"must_not"`
+	Basic     CCBasic           `json:"basic"`
+	Must      CCReqMust         `json:"must"`
+	MustNot   CCReqMust         `json:"must_not"`
+	Aggs      map[string]CCAgg  `json:"aggs"`
+	Highlight CCHighlight       `json:"highlight"`
+	Query     *CCQueryNode      `json:"query"`
+	Score     CCScore           `json:"score"`
+	Collapse  CCCollapse        `json:"collapse"`
+	Suggest   CCSuggest         `json:"suggest"`
+	Ids       []string          `json:"ids"`
+	Template  string            `json:"template"`
+	Params    map[string]string `json:"params"`
 }
 
 type CCParamData struct {
@@ -57,79 +71,283 @@ type ContentController struct {
 	Param CCParamData
 	IBiz  int
 
-	esIndex string
-	esType  string
+	esClient *ec.ElasticClient
+	esIndex  string
+	esType   string
+
+	nc        string
+	cacheName string
+	cacheKey  string
+	template  string
 
-	cacheKey string
+	debug *contentDebug
 }
 
 func (c *ContentController) Post() {
+	c.search()
+}
+
+// Get 与Post相同的搜索，参数见readParam
+func (c *ContentController) Get() {
+	c.search()
+}
+
+func (c *ContentController) search() {
 	var err error
 	res := make(map[string]interface{})
 
-	err = json.Unmarshal(c.Ctx.Input.RequestBody, &c.Param)
+	c.prepare("", "content_info", res)
+
+	q, err := c.compileQuery(&c.Param.Req)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	ss, err := c.compileSearch(&c.Param, c.IBiz, q)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	if c.debug != nil {
+		ss = ss.Profile(true).Explain(true)
+	}
+
+	searchlog := querySource(q)
+	t := time.Now()
+	resEs, errEs := c.esClient.Client.Search().Index(c.esIndex).Type(c.esType).Preference("_primary_first").SearchSource(ss).Do(context.TODO())
+	if errEs != nil {
+		G_logger.Logger().Warn(searchlog)
+		c.outMsg(-1, searchlog, res)
+	}
+	G_logger.Logger().Info(searchlog)
+	esCost := time.Since(t)
+
+	t = time.Now()
+	res, err = c.parseSearchResult(&c.Param, c.IBiz, c.esClient, resEs)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+
+	// 调试信息不写入缓存
+	if c.debug != nil {
+		c.debug.timing("es", esCost)
+		c.debug.timing("parse", time.Since(t))
+		c.debug.query, _ = ss.Source()
+		c.debug.profile = resEs.Profile
+		res["_debug"] = c.debug.output()
+	} else if c.nc == "yes" {
+		bdata := c.setCache(c.cacheName, c.cacheKey, res)
+		c.AppendCtx(fmt.Sprintf("reqdata=[%s]", bdata))
+	}
+
+	c.setCacheControl()
+	c.outMsg(0, "OK", res)
+}
+
+// prepare 解析请求、校验签名并找到路由，命中缓存时直接输出
+// kind用于区分同一请求体在不同接口下的缓存，搜索接口为空；cacheName为使用的bcache
+func (c *ContentController) prepare(kind, cacheName string, res interface{}) {
+	body, err := c.readParam()
 	if err != nil {
-		c.outMsg(-1, "invalid post data. err: "+err.Error(), res)
+		c.outMsg(-1, err.Error(), errorData(err))
 	}
-	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(c.Ctx.Input.RequestBody)))
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(body)))
 
-	c.IBiz, err = strconv.Atoi(c.Param.Req.Basic.IBiz)
-	if err != nil || c.Param.Req.Basic.IBiz == "" {
-		c.outMsg(-1, "invalid ibiz", res)
+	t := time.Now()
+	c.IBiz, c.template, err = c.checkParam(&c.Param)
+	if err != nil {
+		c.outMsg(-1, err.Error(), errorData(err))
 	}
-	if c.Param.Req.Basic.Source == "" {
-		c.outMsg(-1, "invalid source", res)
+	if c.template != "" {
+		c.AppendCtx(fmt.Sprintf("template=%s", c.template))
 	}
-	if common.CheckSign(c.Param.Req.Basic.Sign,
-		c.Param.Req.Basic.Source,
-		c.Param.Req.Basic.Timestamp,
-		c.IBiz) == false {
-		c.outMsg(-1, "check sign error", res)
+	if c.Param.Req.Basic.Debug == "yes" {
+		c.debug = newContentDebug()
+		c.debug.timing("sign", time.Since(t))
+		c.debug.shareURL = shareURL(body)
 	}
 
+	route, err := G_router.Lookup(c.IBiz, c.Param.Req.Basic.Source)
+	if err != nil {
+		c.outMsg(-1, "invalid ibiz route", res)
+	}
+	c.esClient = G_ec[route.Cluster]
+	c.esIndex = route.Index
+	c.esType = route.Type
+
 	// search cache
-	nc := "yes"
+	c.nc = "yes"
 	if c.Param.Req.Basic.Nc == "no" {
-		nc = "no"
+		c.nc = "no"
 	}
 
-	if nc == "yes" {
-		c.cacheKey = fmt.Sprintf("%X", md5.Sum(c.Ctx.Input.RequestBody))
-		cacheData, err := G_cache["content_info"].Get(c.cacheKey)
-		if err == nil && cacheData != "" {
-			var data map[string]interface{}
-			err = json.Unmarshal([]byte(cacheData), &data)
-			if err == nil {
-				c.outMsg(0, "OK", data)
+	if c.nc == "yes" {
+		c.cacheName = cacheName
+		c.cacheKey = contentCacheKey(kind, c.template, route, body)
+		t = time.Now()
+		data, ok := c.getCache(c.cacheName, c.cacheKey)
+		if c.debug != nil {
+			// 调试模式总是查询es，只报告缓存状态
+			c.debug.timing("cache", time.Since(t))
+			c.debug.cacheKey = c.cacheKey
+			c.debug.cacheStatus = "miss"
+			if ok {
+				c.debug.cacheStatus = "hit"
 			}
+		} else if ok {
+			c.setCacheControl()
+			c.outMsg(0, "OK", data)
+		}
+	}
+}
+
+// checkParam 校验签名与请求参数，返回ibiz与模板版本
+// 先校验签名再展开模板，未签名的请求不会查询模板；展开后的请求再整体校验
+// 模板版本为name@version，不使用模板时为空，模板切换版本后缓存随之失效
+func (c *ContentController) checkParam(param *CCParamData) (int, string, error) {
+	var errs ValidationErrors
+	basic := &param.Req.Basic
+	ibiz := validateIdentity("req.basic", basic, &errs)
+	if len(errs) > 0 {
+		return 0, "", errs
+	}
+	if common.CheckSign(basic.Sign,
+		basic.Source,
+		basic.Timestamp,
+		ibiz) == false {
+		errs.add("req.basic.sign", ERR_CODE_SIGN, "check sign error")
+		return 0, "", errs
+	}
+
+	template := ""
+	if param.Req.Template != "" {
+		version, err := expandTemplate(&param.Req)
+		if err != nil {
+			return 0, "", err
 		}
+		template = fmt.Sprintf("%s@%d", param.Req.Template, version)
 	}
 
+	errs = c.validateParam(param)
+	if len(errs) > 0 {
+		return 0, "", errs
+	}
+	// debug会带出查询、打分与缓存细节，除来源外还要求带密钥的签名
+	if basic.Debug == "yes" {
+		if !inSourceList("content::debugSources", basic.Source) {
+			errs.add("req.basic.debug", ERR_CODE_FORBIDDEN, "debug is only allowed for internal sources")
+			return 0, "", errs
+		}
+		errs = checkSecretSign("req.basic", basic, ibiz, c.Ctx.Input.Header(SIGN_HEADER), c.signedBody())
+		if len(errs) > 0 {
+			return 0, "", errs
+		}
+	}
+	// 字段权限按签名后的来源检查
+	G_acl.Lookup(ibiz, basic.Source).validate(param, &errs)
+	if len(errs) > 0 {
+		return 0, "", errs
+	}
+
+	return ibiz, template, nil
+}
+
+// signedBody 带密钥的签名覆盖的原始请求内容，GET请求为url中的查询串
+func (c *ContentController) signedBody() []byte {
+	if c.Ctx.Input.IsGet() {
+		return []byte(c.Ctx.Request.URL.RawQuery)
+	}
+	return c.Ctx.Input.RequestBody
+}
+
+// contentCacheKey 响应缓存的key，包含索引的写入代数，写入后旧的缓存不再命中
+func contentCacheKey(kind, template string, route *ContentRoute, body []byte) string {
+	prefix := fmt.Sprintf("%s%s|%d|", kind, template, cacheGeneration(route))
+	return fmt.Sprintf("%X", md5.Sum(append([]byte(prefix), body...)))
+}
+
+func (c *ContentController) getCache(name, key string) (map[string]interface{}, bool) {
+	cacheData, err := G_cache[name].Get(key)
+	if err != nil || cacheData == "" {
+		return nil, false
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal([]byte(cacheData), &data)
+	if err != nil {
+		return nil, false
+	}
+
+	return data, true
+}
+
+func (c *ContentController) setCache(name, key string, res map[string]interface{}) string {
+	bdata, err := json.Marshal(res)
+	if err == nil {
+		G_cache[name].Set(key, string(bdata))
+	}
+
+	return string(bdata)
+}
+
+// compileQuery 将must、must_not及query编译为es的bool查询
+func (c *ContentController) compileQuery(req *CCReqParam) (*elastic.BoolQuery, error) {
+	var err error
 	q := elastic.NewBoolQuery()
 	// must need
-	c.parseMustNeed(q, c.Param.Req.Must.Need)
+	c.parseMustNeed(q, req.Must.Need)
 	// must range
-	c.parseMustRange(q, c.Param.Req.Must.Range)
+	err = c.parseMustRange(q, req.Must.Range)
+	if err != nil {
+		return nil, err
+	}
 	// must match
-	c.parseMustMatch(q, c.Param.Req.Must.Match)
+	c.parseMustMatch(q, req.Must.Match)
 	// must should
-	c.parseMustShould(q, c.Param.Req.Must.Should)
+	err = c.parseMustShould(q, req.Must.Should)
+	if err != nil {
+		return nil, err
+	}
 
 	// must not need
-	c.parseMustNotNeed(q, c.Param.Req.MustNot.Need)
+	c.parseMustNotNeed(q, req.MustNot.Need)
 	// must not match
-	c.parseMustNotMatch(q, c.Param.Req.MustNot.Match)
+	c.parseMustNotMatch(q, req.MustNot.Match)
 	// must not range
-	c.parseMustNotRange(q, c.Param.Req.MustNot.Range)
+	err = c.parseMustNotRange(q, req.MustNot.Range)
+	if err != nil {
+		return nil, err
+	}
 	// must not should
-	c.parseMustNotShould(q, c.Param.Req.MustNot.Should)
-
-	c.esIndex = "index"
-	c.esType = "type"
-	query := G_ec["yxs"].Client.Search().Index(c.esIndex).Type(c.esType).Preference("_primary_first").Timeout("1s").Query(q)
-	if c.Param.Req.Basic.Page != "" {
-		page, _ := strconv.Atoi(c.Param.Req.Basic.Page)
-		pagesize, _ := strconv.Atoi(c.Param.Req.Basic.Pagesize)
+	err = c.parseMustNotShould(q, req.MustNot.Should)
+	if err != nil {
+		return nil, err
+	}
+
+	// query tree
+	if req.Query != nil {
+		err = c.parseQuery(q, req.Query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// compileSearch 在查询的基础上加入打分、分页、排序、游标、高亮、聚合与折叠
+func (c *ContentController) compileSearch(param *CCParamData, ibiz int, q elastic.Query) (*elastic.SearchSource, error) {
+	var err error
+	basic := &param.Req.Basic
+
+	if len(param.Req.Score.Functions) > 0 {
+		q, err = c.parseScore(q, param.Req.Score)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ss := elastic.NewSearchSource().Query(q).Timeout("1s").FetchSourceContext(ec.NewFetchSourceContext(param.Res))
+	if basic.Page != "" {
+		page, _ := strconv.Atoi(basic.Page)
+		pagesize, _ := strconv.Atoi(basic.Pagesize)
 		if page == 0 {
 			page = 1
 		}
@@ -137,58 +355,96 @@ func (c *ContentController) Post() {
 			pagesize = 10
 		}
 		start := (page - 1) * pagesize
-		query = query.From(start)
+		ss = ss.From(start)
 	}
-	if c.Param.Req.Basic.Pagesize != "" {
-		limit, _ := strconv.Atoi(c.Param.Req.Basic.Pagesize)
+	if basic.Pagesize != "" {
+		limit, _ := strconv.Atoi(basic.Pagesize)
 		if limit == 0 {
 			limit = 10
 		}
-		query = query.Size(limit)
+		ss = ss.Size(limit)
 	}
-	if c.Param.Req.Basic.Sort != "" && c.Param.Req.Basic.Desc != "" {
-		sorts := strings.Split(c.Param.Req.Basic.Sort, ",")
-		descs := strings.Split(c.Param.Req.Basic.Desc, ",")
-		if len(sorts) != len(descs) {
-			c.outMsg(-1, "invalid sort and desc", res)
+	sorted := false
+	tiebreaker := false
+	if basic.Sort != "" && basic.Desc != "" {
+		ss, tiebreaker, err = parseSort(ss, basic)
+		if err != nil {
+			return nil, err
 		}
-		for idx, d := range descs {
-			desc := true
-			if d == "yes" {
-				desc = false
-			}
-			sort := sorts[idx]
-			query = query.Sort(sort, desc)
+		sorted = true
+	} else if basic.Cursor != "" {
+		ss = ss.Sort("_score", false)
+	}
+	// 只在游标翻页时追加，es6按_id排序会加载fielddata，普通排序不需要
+	if !tiebreaker && basic.Cursor != "" {
+		ss = ss.Sort(CURSOR_TIEBREAKER, true)
+	}
+	// 按字段排序时es默认不计算打分，自定义打分时保留_score
+	if sorted && len(param.Req.Score.Functions) > 0 {
+		ss = ss.TrackScores(true)
+	}
+	if basic.Cursor != "" && basic.Cursor != CURSOR_START {
+		sortValues, err := decodeCursor(basic.Cursor, cursorScope(basic, ibiz))
+		if err != nil {
+			return nil, err
 		}
+		ss = ss.SearchAfter(sortValues...)
 	}
-
-	resEs, errEs := query.Do(context.TODO())
-	if errEs != nil {
-		searchlog := ""
-		src, err := q.Source()
-		if err == nil {
-			bdata, err := json.Marshal(src)
-			if err == nil {
-				searchlog = string(bdata)
-			}
+	if len(param.Req.Highlight.Fields) > 0 {
+		ss, err = c.parseHighlight(ss, param.Req.Highlight)
+		if err != nil {
+			return nil, err
 		}
-		G_logger.Logger().Warn(searchlog)
-		c.outMsg(-1, searchlog, res)
 	}
+	if len(param.Req.Aggs) > 0 {
+		ss, err = c.parseAggs(ss, param.Req.Aggs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if param.Req.Collapse.Field != "" {
+		ss, err = c.parseCollapse(ss, param.Req.Collapse, param.Res)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ss, nil
+}
 
-	src, _ := q.Source()
-	bdata, _ := json.Marshal(src)
-	G_logger.Logger().Info(string(bdata))
+// parseSearchResult 解析es返回，生成items、total、分页及游标等输出
+func (c *ContentController) parseSearchResult(param *CCParamData, ibiz int, client *ec.ElasticClient, resEs *elastic.SearchResult) (map[string]interface{}, error) {
+	var err error
+	res := make(map[string]interface{})
+	basic := &param.Req.Basic
 
+	// 折叠后按组数分页
 	total := resEs.Hits.TotalHits
+	if param.Req.Collapse.Field != "" {
+		res["total_hits"] = total
+		total = collapseTotal(resEs)
+	}
 
 	// parseDoc
+	acl := G_acl.Lookup(ibiz, basic.Source)
 	var items []map[string]interface{}
 	for _, hit := range resEs.Hits.Hits {
-		item, err := G_ec["yxs"].ParseDoc(hit.Source, c.Param.Res)
+		item, err := client.ParseDoc(hit.Source, param.Res)
 		if err != nil {
-			c.outMsg(-1, "parse doc failed. err: "+err.Error(), res)
-			continue
+			return res, errors.New("parse doc failed. err: " + err.Error())
+		}
+		acl.mask(item)
+		if hit.Explanation != nil {
+			item["_explanation"] = hit.Explanation
+		}
+		if len(param.Req.Highlight.Fields) > 0 {
+			item["_highlight"] = c.parseHighlightResult(hit.Highlight, param.Req.Highlight)
+		}
+		if param.Req.Collapse.InnerHits != "" || param.Req.Collapse.GroupSize == "yes" {
+			item["_group"], err = c.parseCollapseResult(client, hit, param.Req.Collapse, param.Res, acl)
+			if err != nil {
+				return res, errors.New("parse doc failed. err: " + err.Error())
+			}
 		}
 		items = append(items, item)
 	}
@@ -196,9 +452,12 @@ func (c *ContentController) Post() {
 	// create result
 	res["items"] = items
 	res["total"] = total
-	if c.Param.Req.Basic.Page != "" {
-		page, _ := strconv.Atoi(c.Param.Req.Basic.Page)
-		pagesize, _ := strconv.Atoi(c.Param.Req.Basic.Pagesize)
+	if len(param.Req.Aggs) > 0 {
+		res["aggs"] = parseAggsResult(resEs.Aggregations, param.Req.Aggs)
+	}
+	if basic.Page != "" {
+		page, _ := strconv.Atoi(basic.Page)
+		pagesize, _ := strconv.Atoi(basic.Pagesize)
 		if page == 0 {
 			page = 1
 		}
@@ -210,16 +469,65 @@ func (c *ContentController) Post() {
 		res["totalpage"] = math.Ceil(float64(total) / float64(pagesize))
 		res["pagesize"] = math.Max(math.Min(float64(int(total)-start), float64(pagesize)), 0)
 	}
+	if basic.Cursor != "" {
+		pagesize, _ := strconv.Atoi(basic.Pagesize)
+		if pagesize == 0 {
+			pagesize = 10
+		}
+		nextCursor := ""
+		hits := resEs.Hits.Hits
+		if len(hits) > 0 && len(hits) >= pagesize {
+			nextCursor, err = encodeCursor(hits[len(hits)-1].Sort, cursorScope(basic, ibiz))
+			if err != nil {
+				return res, errors.New("create cursor failed. err: " + err.Error())
+			}
+		}
+		res["next_cursor"] = nextCursor
+	}
 
-	if nc == "yes" {
-		bdata, err := json.Marshal(res)
-		if err == nil {
-			G_cache["content_info"].Set(c.cacheKey, string(bdata))
+	return res, nil
+}
+
+// querySource 查询或SearchSource的json，用于记录日志
+func querySource(q elastic.Query) string {
+	src, err := q.Source()
+	if err != nil {
+		return ""
+	}
+	bdata, err := json.Marshal(src)
+	if err != nil {
+		return ""
+	}
+
+	return string(bdata)
+}
+
+// parseSort 按sort、desc排序，desc为yes时降序，返回排序中是否已包含CURSOR_TIEBREAKER
+func parseSort(ss *elastic.SearchSource, basic *CCBasic) (*elastic.SearchSource, bool, error) {
+	sorts := strings.Split(basic.Sort, ",")
+	descs := strings.Split(basic.Desc, ",")
+	if len(sorts) != len(descs) {
+		return nil, false, errors.New("invalid sort and desc")
+	}
+	tiebreaker := false
+	for idx, d := range descs {
+		desc := true
+		if d == "yes" {
+			desc = false
 		}
-		c.AppendCtx(fmt.Sprintf("reqdata=[%s]", string(bdata)))
+		sort := sorts[idx]
+		if sort == CURSOR_TIEBREAKER {
+			tiebreaker = true
+		}
+		ss = ss.Sort(sort, desc)
 	}
 
-	c.outMsg(0, "OK", res)
+	return ss, tiebreaker, nil
+}
+
+// cursorScope 游标只对同一来源、同一业务、同样的排序有效
+func cursorScope(basic *CCBasic, ibiz int) string {
+	return fmt.Sprintf("%s|%d|%s|%s", basic.Source, ibiz, basic.Sort, basic.Desc)
 }
 
 func (c *ContentController) parseMustNeed(q *elastic.BoolQuery, need map[string]string) {
@@ -228,43 +536,16 @@ func (c *ContentController) parseMustNeed(q *elastic.BoolQuery, need map[string]
 	}
 }
 
-func (c *ContentController) parseMustRange(q *elastic.BoolQuery, rg map[string]string) {
+func (c *ContentController) parseMustRange(q *elastic.BoolQuery, rg map[string]string) error {
 	for field, value := range rg {
-		parts := strings.Split(value, "|")
-		if len(parts) != 3 {
-			c.outMsg(-1, "invalid range: "+value, "")
-		}
-		switch parts[2] {
-		case "T":
-			stime := ""
-			etime := ""
-			if parts[0] != "" {
-				tt, err := strconv.ParseInt(parts[0], 10, 64)
-				if err != nil {
-					c.outMsg(-1, "invalid stime "+parts[0], "")
-				}
-				stime = time.Unix(tt, 0).Format("2006-01-02 15:04:05")
-			}
-			if parts[1] != "" {
-				tt, err := strconv.ParseInt(parts[1], 10, 64)
-				if err != nil {
-					c.outMsg(-1, "invalid etime "+parts[1], "")
-				}
-				etime = time.Unix(tt, 0).Format("2006-01-02 15:04:05")
-			}
-			q = q.Filter(elastic.NewRangeQuery(field).Format("yyyy-MM-dd HH:mm:ss").Gte(stime))
-			q = q.Filter(elastic.NewRangeQuery(field).Format("yyyy-MM-dd HH:mm:ss").Lte(etime))
-		case "N":
-			q = q.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			q = q.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
-		case "S":
-			q = q.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			q = q.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
-		default:
-			q = q.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			q = q.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
+		r, err := parseRange(value)
+		if err != nil {
+			return errors.New("invalid range " + field + ": " + err.Error())
 		}
+		q = q.Filter(r.query(field))
 	}
+
+	return nil
 }
 
 func (c *ContentController) parseMustMatch(q *elastic.BoolQuery, match map[string]string) {
@@ -273,7 +554,7 @@ func (c *ContentController) parseMustMatch(q *elastic.BoolQuery, match map[strin
 	}
 }
 
-func (c *ContentController) parseMustShould(q *elastic.BoolQuery, should []CCReqMustWithoutShould) {
+func (c *ContentController) parseMustShould(q *elastic.BoolQuery, should []CCReqMustWithoutShould) error {
 	if len(should) > 0 {
 		qs := elastic.NewBoolQuery()
 		for _, s := range should {
@@ -281,7 +562,10 @@ func (c *ContentController) parseMustShould(q *elastic.BoolQuery, should []CCReq
 			// must should need
 			c.parseMustNeed(qt, s.Need)
 			// must should range
-			c.parseMustRange(qt, s.Range)
+			err := c.parseMustRange(qt, s.Range)
+			if err != nil {
+				return err
+			}
 			// must should range
 			c.parseMustMatch(qt, s.Match)
 
@@ -289,6 +573,8 @@ func (c *ContentController) parseMustShould(q *elastic.BoolQuery, should []CCReq
 		}
 		q = q.Must(qs)
 	}
+
+	return nil
 }
 
 func (c *ContentController) parseMustNotNeed(q *elastic.BoolQuery, need map[string]string) {
@@ -297,51 +583,16 @@ func (c *ContentController) parseMustNotNeed(q *elastic.BoolQuery, need map[stri
 	}
 }
 
-func (c *ContentController) parseMustNotRange(q *elastic.BoolQuery, rg map[string]string) {
+func (c *ContentController) parseMustNotRange(q *elastic.BoolQuery, rg map[string]string) error {
 	for field, value := range rg {
-		parts := strings.Split(value, "|")
-		if len(parts) != 3 {
-			c.outMsg(-1, "invalid range: "+value, "")
-		}
-		switch parts[2] {
-		case "T":
-			stime := ""
-			etime := ""
-			if parts[0] != "" {
-				tt, err := strconv.ParseInt(parts[0], 10, 64)
-				if err != nil {
-					c.outMsg(-1, "invalid stime "+parts[0], "")
-				}
-				stime = time.Unix(tt, 0).Format("2006-01-02 15:04:05")
-			}
-			if parts[1] != "" {
-				tt, err := strconv.ParseInt(parts[1], 10, 64)
-				if err != nil {
-					c.outMsg(-1, "invalid etime "+parts[1], "")
-				}
-				etime = time.Unix(tt, 0).Format("2006-01-02 15:04:05")
-			}
-			qt := elastic.NewBoolQuery()
-			qt = qt.Filter(elastic.NewRangeQuery(field).Format("yyyy-MM-dd HH:mm:ss").Gte(stime))
-			qt = qt.Filter(elastic.NewRangeQuery(field).Format("yyyy-MM-dd HH:mm:ss").Lte(etime))
-			q = q.MustNot(qt)
-		case "N":
-			qt := elastic.NewBoolQuery()
-			qt = qt.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			qt = qt.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
-			q = q.MustNot(qt)
-		case "S":
-			qt := elastic.NewBoolQuery()
-			qt = qt.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			qt = qt.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
-			q = q.MustNot(qt)
-		default:
-			qt := elastic.NewBoolQuery()
-			qt = qt.Filter(elastic.NewRangeQuery(field).Gte(parts[0]))
-			qt = qt.Filter(elastic.NewRangeQuery(field).Lte(parts[1]))
-			q = q.MustNot(qt)
+		r, err := parseRange(value)
+		if err != nil {
+			return errors.New("invalid range " + field + ": " + err.Error())
 		}
+		q = q.MustNot(r.query(field))
 	}
+
+	return nil
 }
 
 func (c *ContentController) parseMustNotMatch(q *elastic.BoolQuery, match map[string]string) {
@@ -350,7 +601,7 @@ func (c *ContentController) parseMustNotMatch(q *elastic.BoolQuery, match map[st
 	}
 }
 
-func (c *ContentController) parseMustNotShould(q *elastic.BoolQuery, should []CCReqMustWithoutShould) {
+func (c *ContentController) parseMustNotShould(q *elastic.BoolQuery, should []CCReqMustWithoutShould) error {
 	if len(should) > 0 {
 		qs := elastic.NewBoolQuery()
 		for _, s := range should {
@@ -358,7 +609,10 @@ func (c *ContentController) parseMustNotShould(q *elastic.BoolQuery, should []CC
 			// must should need
 			c.parseMustNeed(qt, s.Need)
 			// must should range
-			c.parseMustRange(qt, s.Range)
+			err := c.parseMustRange(qt, s.Range)
+			if err != nil {
+				return err
+			}
 			// must should range
 			c.parseMustMatch(qt, s.Match)
 
@@ -366,4 +620,6 @@ func (c *ContentController) parseMustNotShould(q *elastic.BoolQuery, should []CC
 		}
 		q = q.MustNot(qs)
 	}
+
+	return nil
 }
@@ -0,0 +1,400 @@
+package controllers
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ec "beego_framework/common/elastic"
+
+	"github.com/astaxie/beego/config"
+	"go.uber.org/zap"
+)
+
+const (
+	ACL_SOURCE_CONF  = "conf"
+	ACL_SOURCE_MYSQL = "mysql"
+
+	DEFAULT_ACL_REFRESH = 60
+
+	ACL_MASK_HIDE    = "hide"
+	ACL_MASK_PARTIAL = "partial"
+	ACL_MASK_HASH    = "hash"
+)
+
+// ContentACL ibiz(及source)允许过滤、排序与返回的字段，字段支持author.*形式的通配符
+// filter: need/match/range的字段、折叠字段
+// sort: 排序字段与打分函数的字段，_score总是允许
+// res: 返回字段、聚合字段与高亮字段
+// mask为返回字段的脱敏方式，hide不返回，partial只保留首尾，hash返回md5；脱敏字段不能用于过滤、排序、聚合与高亮
+type ContentACL struct {
+	IBiz   int
+	Source string // 为空表示该ibiz下的所有来源
+	Filter []string
+	Sort   []string
+	Res    []string
+	Mask   map[string]string
+}
+
+// ContentACLs 字段权限表，支持从app.conf或mysql加载，并定时刷新
+// 没有配置策略的ibiz不做限制；ibiz配置了策略后，没有匹配到策略的来源不允许使用任何字段
+//
+//	[content_acl]
+//	; ibiz[.source] = filter|sort|res[|mask]，字段用,分隔，mask为字段:方式
+//	160.wmp = type,pubtime,title|pubtime|title,url,author.*|author.phone:partial,author.email:hide
+//
+//	create table tbContentACL (
+//	    iBiz int, sSource varchar(64), sFilter text, sSort text, sRes text, sMask text, iStatus int
+//	)
+type ContentACLs struct {
+	mu    sync.RWMutex
+	acls  map[string]*ContentACL
+	ibizs map[int]bool // 配置了策略的ibiz
+}
+
+func NewContentACLs() *ContentACLs {
+	return &ContentACLs{
+		acls:  make(map[string]*ContentACL),
+		ibizs: make(map[int]bool),
+	}
+}
+
+// Lookup 优先匹配ibiz+source，其次匹配ibiz；ibiz没有任何策略时返回nil，
+// 有策略但来源没有匹配时返回空的策略，所有字段都不允许
+func (a *ContentACLs) Lookup(ibiz int, source string) *ContentACL {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if acl, ok := a.acls[routeKey(ibiz, source)]; ok {
+		return acl
+	}
+	if acl, ok := a.acls[routeKey(ibiz, "")]; ok {
+		return acl
+	}
+	if a.ibizs[ibiz] {
+		return &ContentACL{IBiz: ibiz, Source: source}
+	}
+	return nil
+}
+
+// HasSource 是否有该来源单独的策略
+func (a *ContentACLs) HasSource(source string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, acl := range a.acls {
+		if acl.Source != "" && strings.EqualFold(acl.Source, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload 重新加载字段权限，加载失败时保留旧的权限表
+func (a *ContentACLs) Reload() error {
+	var acls []*ContentACL
+	var err error
+
+	switch G_conf.DefaultString("content::aclSource", ACL_SOURCE_CONF) {
+	case ACL_SOURCE_MYSQL:
+		acls, err = loadACLsFromMysql()
+	default:
+		acls, err = loadACLsFromConf()
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]*ContentACL, len(acls))
+	ibizs := make(map[int]bool)
+	for _, acl := range acls {
+		data[routeKey(acl.IBiz, acl.Source)] = acl
+		ibizs[acl.IBiz] = true
+	}
+
+	a.mu.Lock()
+	a.acls = data
+	a.ibizs = ibizs
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Refresh 定时刷新字段权限
+func (a *ContentACLs) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := a.Reload()
+		if err != nil {
+			G_logger.Logger().Warn("reload content acl failed", zap.Error(err))
+		}
+	}
+}
+
+// loadACLsFromConf 每次重新读取配置文件，没有[content_acl]时不做限制
+func loadACLsFromConf() ([]*ContentACL, error) {
+	conf, err := config.NewConfig("ini", DEFAULT_CONF_PATH)
+	if err != nil {
+		return nil, err
+	}
+	section, err := conf.GetSection("content_acl")
+	if err != nil {
+		return nil, nil
+	}
+
+	var acls []*ContentACL
+	for key, value := range section {
+		keys := strings.SplitN(key, ".", 2)
+		ibiz, err := strconv.Atoi(keys[0])
+		if err != nil {
+			return nil, errors.New("invalid acl key: " + key)
+		}
+		parts := strings.Split(value, "|")
+		if len(parts) != 3 && len(parts) != 4 {
+			return nil, errors.New("invalid acl: " + value)
+		}
+		source := ""
+		if len(keys) == 2 {
+			source = keys[1]
+		}
+		mask := ""
+		if len(parts) == 4 {
+			mask = parts[3]
+		}
+		acl, err := newContentACL(ibiz, source, parts[0], parts[1], parts[2], mask)
+		if err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl)
+	}
+
+	return acls, nil
+}
+
+func loadACLsFromMysql() ([]*ContentACL, error) {
+	m, ok := G_mc[G_conf.String("content::aclMysql")]
+	if !ok {
+		return nil, errors.New("invalid acl mysql")
+	}
+	table := G_conf.DefaultString("content::aclTable", "tbContentACL")
+	rows, err := m.QueryString(context.Background(),
+		fmt.Sprintf("select iBiz,sSource,sFilter,sSort,sRes,sMask from %s where iStatus = 1", table))
+	if err != nil {
+		return nil, err
+	}
+
+	var acls []*ContentACL
+	for _, row := range rows {
+		ibiz, err := strconv.Atoi(row["iBiz"])
+		if err != nil {
+			return nil, errors.New("invalid acl ibiz: " + row["iBiz"])
+		}
+		acl, err := newContentACL(ibiz, row["sSource"], row["sFilter"], row["sSort"], row["sRes"], row["sMask"])
+		if err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl)
+	}
+
+	return acls, nil
+}
+
+func newContentACL(ibiz int, source, filter, sort, res, mask string) (*ContentACL, error) {
+	acl := &ContentACL{
+		IBiz:   ibiz,
+		Source: source,
+		Filter: splitACLFields(filter),
+		Sort:   splitACLFields(sort),
+		Res:    splitACLFields(res),
+		Mask:   make(map[string]string),
+	}
+	for _, m := range splitACLFields(mask) {
+		parts := strings.Split(m, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("invalid acl mask: " + m)
+		}
+		switch parts[1] {
+		case ACL_MASK_HIDE, ACL_MASK_PARTIAL, ACL_MASK_HASH:
+		default:
+			return nil, errors.New("invalid acl mask: " + m)
+		}
+		acl.Mask[parts[0]] = parts[1]
+	}
+
+	return acl, nil
+}
+
+func splitACLFields(value string) []string {
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// matchACLField 字段是否匹配允许列表中的某一项，请求中的通配符需要列表中有同样或更宽的通配符
+func matchACLField(patterns []string, field string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// masked 字段本身或其下的字段是否需要脱敏
+func (acl *ContentACL) masked(field string) bool {
+	for f := range acl.Mask {
+		if ok, _ := path.Match(field, f); ok {
+			return true
+		}
+		if ok, _ := path.Match(f, field); ok || strings.HasPrefix(f, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// validate 检查请求中用到的字段，在编译查询之前调用，acl为nil时不做限制
+func (acl *ContentACL) validate(param *CCParamData, errs *ValidationErrors) {
+	if acl == nil {
+		return
+	}
+	req := &param.Req
+
+	acl.validateFilter("req.must", req.Must.Need, req.Must.Range, req.Must.Match, errs)
+	for i, s := range req.Must.Should {
+		acl.validateFilter(fmt.Sprintf("req.must.should[%d]", i), s.Need, s.Range, s.Match, errs)
+	}
+	acl.validateFilter("req.must_not", req.MustNot.Need, req.MustNot.Range, req.MustNot.Match, errs)
+	for i, s := range req.MustNot.Should {
+		acl.validateFilter(fmt.Sprintf("req.must_not.should[%d]", i), s.Need, s.Range, s.Match, errs)
+	}
+	if req.Query != nil {
+		acl.validateQueryNode("req.query", req.Query, errs)
+	}
+	if req.Collapse.Field != "" && (!matchACLField(acl.Filter, req.Collapse.Field) || acl.masked(req.Collapse.Field)) {
+		errs.add("req.collapse.field", ERR_CODE_FIELD_DENIED, "field "+req.Collapse.Field+" is not allowed to filter")
+	}
+
+	if req.Basic.Sort != "" {
+		for _, field := range strings.Split(req.Basic.Sort, ",") {
+			if field != "_score" && (!matchACLField(acl.Sort, field) || acl.masked(field)) {
+				errs.add("req.basic.sort", ERR_CODE_FIELD_DENIED, "field "+field+" is not allowed to sort")
+			}
+		}
+	}
+	for i, f := range req.Score.Functions {
+		path := fmt.Sprintf("req.score.functions[%d]", i)
+		if f.Field != "" && (!matchACLField(acl.Sort, f.Field) || acl.masked(f.Field)) {
+			errs.add(path+".field", ERR_CODE_FIELD_DENIED, "field "+f.Field+" is not allowed to sort")
+		}
+		if f.Filter != nil {
+			acl.validateQueryNode(path+".filter", f.Filter, errs)
+		}
+	}
+
+	for i, field := range param.Res {
+		if !matchACLField(acl.Res, field) {
+			errs.add(fmt.Sprintf("res[%d]", i), ERR_CODE_FIELD_DENIED, "field "+field+" is not allowed to return")
+		}
+	}
+	// 聚合与高亮会带出字段原值，脱敏字段不允许使用；过滤与排序同理，可用来推测原值，游标中也会带出排序值
+	acl.validateAggs("req.aggs", req.Aggs, errs)
+	for i, field := range req.Highlight.Fields {
+		if !matchACLField(acl.Res, field) || acl.masked(field) {
+			errs.add(fmt.Sprintf("req.highlight.fields[%d]", i), ERR_CODE_FIELD_DENIED, "field "+field+" is not allowed to highlight")
+		}
+	}
+}
+
+func (acl *ContentACL) validateFilter(path string, need, rg, match map[string]string, errs *ValidationErrors) {
+	for _, c := range []struct {
+		name   string
+		fields map[string]string
+	}{
+		{"need", need},
+		{"range", rg},
+		{"match", match},
+	} {
+		for field := range c.fields {
+			if !matchACLField(acl.Filter, field) || acl.masked(field) {
+				errs.add(path+"."+c.name+"."+field, ERR_CODE_FIELD_DENIED, "field "+field+" is not allowed to filter")
+			}
+		}
+	}
+}
+
+func (acl *ContentACL) validateQueryNode(path string, node *CCQueryNode, errs *ValidationErrors) {
+	acl.validateFilter(path, node.Need, node.Range, node.Match, errs)
+
+	children := []struct {
+		name  string
+		nodes []CCQueryNode
+	}{
+		{"must", node.Must},
+		{"filter", node.Filter},
+		{"must_not", node.MustNot},
+		{"should", node.Should},
+	}
+	for _, child := range children {
+		for i := range child.nodes {
+			acl.validateQueryNode(fmt.Sprintf("%s.%s[%d]", path, child.name, i), &child.nodes[i], errs)
+		}
+	}
+}
+
+func (acl *ContentACL) validateAggs(path string, aggs map[string]CCAgg, errs *ValidationErrors) {
+	for name, a := range aggs {
+		if a.Field != "" && (!matchACLField(acl.Res, a.Field) || acl.masked(a.Field)) {
+			errs.add(path+"."+name+".field", ERR_CODE_FIELD_DENIED, "field "+a.Field+" is not allowed to aggregate")
+		}
+		acl.validateAggs(path+"."+name+".aggs", a.Aggs, errs)
+	}
+}
+
+// mask 对返回的文档脱敏，acl为nil时不处理
+func (acl *ContentACL) mask(item map[string]interface{}) {
+	if acl == nil {
+		return
+	}
+	for field, mode := range acl.Mask {
+		for _, v := range ec.ResolveField(item, field) {
+			if mode == ACL_MASK_HIDE {
+				delete(v.Parent, v.Name)
+			} else if v.Value != nil {
+				v.Parent[v.Name] = maskValue(v.Value, mode)
+			}
+		}
+	}
+}
+
+// maskValue partial保留首尾各四分之一，如13812345678输出13*******78
+func maskValue(value interface{}, mode string) interface{} {
+	if arr, ok := value.([]interface{}); ok {
+		res := make([]interface{}, len(arr))
+		for i, v := range arr {
+			res[i] = maskValue(v, mode)
+		}
+		return res
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		s = fmt.Sprint(value)
+	}
+	if mode == ACL_MASK_HASH {
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	runes := []rune(s)
+	keep := len(runes) / 4
+	return string(runes[:keep]) + strings.Repeat("*", len(runes)-2*keep) + string(runes[len(runes)-keep:])
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_AGGS_DEPTH = 3
+	MAX_AGGS_SIZE  = 1000
+
+	DEFAULT_AGGS_SIZE = 10
+)
+
+type CCAggRange struct {
+	Key  string `json:"key"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// CCAgg aggs请求，支持terms, histogram, date_histogram, range, stats，可通过aggs嵌套
+type CCAgg struct {
+	Type     string           `json:"type"`
+	Field    string           `json:"field"`
+	Size     string           `json:"size"`
+	Interval string           `json:"interval"`
+	Format   string           `json:"format"`
+	Ranges   []CCAggRange     `json:"ranges"`
+	Aggs     map[string]CCAgg `json:"aggs"`
+}
+
+func (c *ContentController) parseAggs(ss *elastic.SearchSource, aggs map[string]CCAgg) (*elastic.SearchSource, error) {
+	for name, a := range aggs {
+		agg, err := buildAgg(name, a, 1)
+		if err != nil {
+			return ss, err
+		}
+		ss = ss.Aggregation(name, agg)
+	}
+
+	return ss, nil
+}
+
+func buildAgg(name string, a CCAgg, depth int) (elastic.Aggregation, error) {
+	if depth > MAX_AGGS_DEPTH {
+		return nil, errors.New("aggs too deep: " + name)
+	}
+	if name == "" || a.Field == "" {
+		return nil, errors.New("invalid aggs: " + name)
+	}
+
+	subs := make(map[string]elastic.Aggregation)
+	for subName, sub := range a.Aggs {
+		subAgg, err := buildAgg(subName, sub, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		subs[subName] = subAgg
+	}
+
+	switch a.Type {
+	case "terms":
+		size := DEFAULT_AGGS_SIZE
+		if a.Size != "" {
+			n, err := strconv.Atoi(a.Size)
+			if err != nil || n <= 0 || n > MAX_AGGS_SIZE {
+				return nil, errors.New("invalid aggs size: " + name)
+			}
+			size = n
+		}
+		agg := elastic.NewTermsAggregation().Field(a.Field).Size(size)
+		for subName, subAgg := range subs {
+			agg = agg.SubAggregation(subName, subAgg)
+		}
+		return agg, nil
+	case "histogram":
+		interval, err := strconv.ParseFloat(a.Interval, 64)
+		if err != nil || interval <= 0 {
+			return nil, errors.New("invalid aggs interval: " + name)
+		}
+		agg := elastic.NewHistogramAggregation().Field(a.Field).Interval(interval).MinDocCount(0)
+		for subName, subAgg := range subs {
+			agg = agg.SubAggregation(subName, subAgg)
+		}
+		return agg, nil
+	case "date_histogram":
+		if a.Interval == "" {
+			return nil, errors.New("invalid aggs interval: " + name)
+		}
+		format := a.Format
+		if format == "" {
+			format = "yyyy-MM-dd HH:mm:ss"
+		}
+		agg := elastic.NewDateHistogramAggregation().Field(a.Field).Interval(a.Interval).Format(format).MinDocCount(0)
+		for subName, subAgg := range subs {
+			agg = agg.SubAggregation(subName, subAgg)
+		}
+		return agg, nil
+	case "range":
+		if len(a.Ranges) == 0 {
+			return nil, errors.New("invalid aggs ranges: " + name)
+		}
+		agg := elastic.NewRangeAggregation().Field(a.Field)
+		for _, r := range a.Ranges {
+			var from, to interface{}
+			if r.From != "" {
+				f, err := strconv.ParseFloat(r.From, 64)
+				if err != nil {
+					return nil, errors.New("invalid aggs range: " + name)
+				}
+				from = f
+			}
+			if r.To != "" {
+				t, err := strconv.ParseFloat(r.To, 64)
+				if err != nil {
+					return nil, errors.New("invalid aggs range: " + name)
+				}
+				to = t
+			}
+			if r.Key != "" {
+				agg = agg.AddRangeWithKey(r.Key, from, to)
+			} else {
+				agg = agg.AddRange(from, to)
+			}
+		}
+		for subName, subAgg := range subs {
+			agg = agg.SubAggregation(subName, subAgg)
+		}
+		return agg, nil
+	case "stats":
+		if len(a.Aggs) > 0 {
+			return nil, errors.New("stats aggs can not be nested: " + name)
+		}
+		return elastic.NewStatsAggregation().Field(a.Field), nil
+	}
+
+	return nil, errors.New("invalid aggs type: " + name)
+}
+
+// parseAggsResult 按请求结构把es的aggregations转换为输出
+func parseAggsResult(result elastic.Aggregations, aggs map[string]CCAgg) map[string]interface{} {
+	res := make(map[string]interface{})
+	for name, a := range aggs {
+		switch a.Type {
+		case "terms":
+			items, ok := result.Terms(name)
+			if !ok {
+				continue
+			}
+			buckets := make([]map[string]interface{}, 0, len(items.Buckets))
+			for _, b := range items.Buckets {
+				bucket := map[string]interface{}{
+					"key":       b.Key,
+					"doc_count": b.DocCount,
+				}
+				if b.KeyAsString != nil {
+					bucket["key_as_string"] = *b.KeyAsString
+				}
+				if len(a.Aggs) > 0 {
+					bucket["aggs"] = parseAggsResult(b.Aggregations, a.Aggs)
+				}
+				buckets = append(buckets, bucket)
+			}
+			res[name] = map[string]interface{}{"buckets": buckets}
+		case "histogram", "date_histogram":
+			items, ok := result.Histogram(name)
+			if !ok {
+				continue
+			}
+			buckets := make([]map[string]interface{}, 0, len(items.Buckets))
+			for _, b := range items.Buckets {
+				bucket := map[string]interface{}{
+					"key":       b.Key,
+					"doc_count": b.DocCount,
+				}
+				if b.KeyAsString != nil {
+					bucket["key_as_string"] = *b.KeyAsString
+				}
+				if len(a.Aggs) > 0 {
+					bucket["aggs"] = parseAggsResult(b.Aggregations, a.Aggs)
+				}
+				buckets = append(buckets, bucket)
+			}
+			res[name] = map[string]interface{}{"buckets": buckets}
+		case "range":
+			items, ok := result.Range(name)
+			if !ok {
+				continue
+			}
+			buckets := make([]map[string]interface{}, 0, len(items.Buckets))
+			for _, b := range items.Buckets {
+				bucket := map[string]interface{}{
+					"key":       b.Key,
+					"doc_count": b.DocCount,
+				}
+				if b.From != nil {
+					bucket["from"] = *b.From
+				}
+				if b.To != nil {
+					bucket["to"] = *b.To
+				}
+				if len(a.Aggs) > 0 {
+					bucket["aggs"] = parseAggsResult(b.Aggregations, a.Aggs)
+				}
+				buckets = append(buckets, bucket)
+			}
+			res[name] = map[string]interface{}{"buckets": buckets}
+		case "stats":
+			stats, ok := result.Stats(name)
+			if !ok {
+				continue
+			}
+			res[name] = map[string]interface{}{
+				"count": stats.Count,
+				"min":   stats.Min,
+				"max":   stats.Max,
+				"avg":   stats.Avg,
+				"sum":   stats.Sum,
+			}
+		}
+	}
+
+	return res
+}
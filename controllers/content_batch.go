@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	ec "beego_framework/common/elastic"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_BATCH_SIZE = 20
+)
+
+// batchItem 批量查询中的单个子请求
+type batchItem struct {
+	param    CCParamData
+	ibiz     int
+	route    *ContentRoute
+	nc       string
+	cacheKey string
+	source   *elastic.SearchSource
+
+	status int
+	msg    string
+	data   map[string]interface{}
+}
+
+func (item *batchItem) fail(err error) {
+	item.status = -1
+	item.msg = err.Error()
+	item.data = errorData(err)
+}
+
+func (item *batchItem) ok(data map[string]interface{}) {
+	item.status = 0
+	item.msg = "OK"
+	item.data = data
+}
+
+// Batch 批量查询，请求体为CCParamData数组
+// 未命中缓存的子请求按es集群合并为一次multi search，单个子请求失败不影响其他子请求
+func (c *ContentController) Batch() {
+	var err error
+	var res []map[string]interface{}
+
+	var bodies []json.RawMessage
+	err = json.Unmarshal(c.Ctx.Input.RequestBody, &bodies)
+	if err != nil {
+		c.outMsg(-1, "invalid post data. err: "+err.Error(), res)
+	}
+	if len(bodies) == 0 || len(bodies) > MAX_BATCH_SIZE {
+		c.outMsg(-1, fmt.Sprintf("invalid batch size, max batch size is %d", MAX_BATCH_SIZE), res)
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(c.Ctx.Input.RequestBody)))
+
+	items := make([]*batchItem, len(bodies))
+	groups := make(map[string][]*batchItem)
+	for i, body := range bodies {
+		item := &batchItem{}
+		items[i] = item
+
+		err = json.Unmarshal(body, &item.param)
+		if err != nil {
+			item.fail(errors.New("invalid post data. err: " + err.Error()))
+			continue
+		}
+		var template string
+		item.ibiz, template, err = c.checkParam(&item.param)
+		if err != nil {
+			item.fail(err)
+			continue
+		}
+		item.route, err = G_router.Lookup(item.ibiz, item.param.Req.Basic.Source)
+		if err != nil {
+			item.fail(errors.New("invalid ibiz route"))
+			continue
+		}
+
+		// search cache
+		item.nc = "yes"
+		if item.param.Req.Basic.Nc == "no" {
+			item.nc = "no"
+		}
+		if item.nc == "yes" {
+			item.cacheKey = contentCacheKey("", template, item.route, body)
+			data, ok := c.getCache("content_info", item.cacheKey)
+			if ok {
+				item.ok(data)
+				continue
+			}
+		}
+
+		q, err := c.compileQuery(&item.param.Req)
+		if err != nil {
+			item.fail(err)
+			continue
+		}
+		item.source, err = c.compileSearch(&item.param, item.ibiz, q)
+		if err != nil {
+			item.fail(err)
+			continue
+		}
+		groups[item.route.Cluster] = append(groups[item.route.Cluster], item)
+	}
+
+	var wg sync.WaitGroup
+	for cluster, group := range groups {
+		wg.Add(1)
+		go func(client *ec.ElasticClient, group []*batchItem) {
+			defer wg.Done()
+			c.multiSearch(client, group)
+		}(G_ec[cluster], group)
+	}
+	wg.Wait()
+
+	for i, item := range items {
+		res = append(res, map[string]interface{}{
+			"status": item.status,
+			"msg":    item.msg,
+			"data":   item.data,
+		})
+		c.AppendCtx(fmt.Sprintf("batch[%d].status=%d batch[%d].msg=%s", i, item.status, i, item.msg))
+	}
+
+	c.outMsg(0, "OK", res)
+}
+
+// multiSearch 同一集群的子请求通过一次multi search完成，结果按顺序写回子请求
+func (c *ContentController) multiSearch(client *ec.ElasticClient, items []*batchItem) {
+	ms := client.Client.MultiSearch()
+	for _, item := range items {
+		ms = ms.Add(elastic.NewSearchRequest().
+			Index(item.route.Index).
+			Type(item.route.Type).
+			Preference("_primary_first").
+			SearchSource(item.source))
+	}
+
+	resEs, err := ms.Do(context.TODO())
+	if err != nil {
+		G_logger.Logger().Warn("multi search failed. err: " + err.Error())
+		for _, item := range items {
+			item.fail(errors.New("multi search failed. err: " + err.Error()))
+		}
+		return
+	}
+
+	for i, item := range items {
+		if i >= len(resEs.Responses) || resEs.Responses[i] == nil {
+			item.fail(errors.New("multi search failed. err: empty response"))
+			continue
+		}
+		r := resEs.Responses[i]
+		if r.Error != nil {
+			item.fail(errors.New("search failed. err: " + r.Error.Reason))
+			continue
+		}
+		data, err := c.parseSearchResult(&item.param, item.ibiz, client, r)
+		if err != nil {
+			item.fail(err)
+			continue
+		}
+		if item.nc == "yes" {
+			c.setCache("content_info", item.cacheKey, data)
+		}
+		item.ok(data)
+	}
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+
+	ec "beego_framework/common/elastic"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_COLLAPSE_INNER_HITS = 10
+
+	COLLAPSE_INNER_HITS = "_group"
+	COLLAPSE_TOTAL_AGG  = "_collapse_total"
+
+	// cardinality的精度阈值，es允许的最大值，组数不超过该值时基本精确
+	COLLAPSE_PRECISION_THRESHOLD = 40000
+)
+
+// CCCollapse 按字段折叠，每组只返回一条代表文档
+// inner_hits为每组额外返回的文档数，group_size为yes时返回每组的文档总数
+type CCCollapse struct {
+	Field     string `json:"field"`
+	InnerHits string `json:"inner_hits"`
+	GroupSize string `json:"group_size"`
+}
+
+// parseCollapse 折叠后total按组数计算，通过cardinality聚合得到组数，保证totalpage按组分页
+// cardinality是近似计数，组数超过COLLAPSE_PRECISION_THRESHOLD时total与totalpage是近似值
+func (c *ContentController) parseCollapse(ss *elastic.SearchSource, collapse CCCollapse, fields []string) (*elastic.SearchSource, error) {
+	cb := elastic.NewCollapseBuilder(collapse.Field)
+
+	size := 0
+	if collapse.InnerHits != "" {
+		n, err := strconv.Atoi(collapse.InnerHits)
+		if err != nil || n < 0 || n > MAX_COLLAPSE_INNER_HITS {
+			return ss, errors.New("invalid collapse inner_hits: " + collapse.InnerHits)
+		}
+		size = n
+	}
+	if size > 0 || collapse.GroupSize == "yes" {
+		innerHit := elastic.NewInnerHit().Name(COLLAPSE_INNER_HITS).Size(size).FetchSourceContext(ec.NewFetchSourceContext(fields))
+		cb = cb.InnerHit(innerHit)
+	}
+
+	ss = ss.Collapse(cb)
+	ss = ss.Aggregation(COLLAPSE_TOTAL_AGG, elastic.NewCardinalityAggregation().Field(collapse.Field).PrecisionThreshold(COLLAPSE_PRECISION_THRESHOLD))
+
+	return ss, nil
+}
+
+// collapseTotal 折叠后的组数，取不到时退回命中的文档数
+func collapseTotal(resEs *elastic.SearchResult) int64 {
+	card, ok := resEs.Aggregations.Cardinality(COLLAPSE_TOTAL_AGG)
+	if !ok || card.Value == nil {
+		return resEs.Hits.TotalHits
+	}
+	return int64(*card.Value)
+}
+
+func (c *ContentController) parseCollapseResult(client *ec.ElasticClient, hit *elastic.SearchHit, collapse CCCollapse, fields []string, acl *ContentACL) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+
+	innerHits, ok := hit.InnerHits[COLLAPSE_INNER_HITS]
+	if !ok || innerHits.Hits == nil {
+		return res, nil
+	}
+	if collapse.GroupSize == "yes" {
+		res["size"] = innerHits.Hits.TotalHits
+	}
+	if collapse.InnerHits != "" {
+		items := make([]map[string]interface{}, 0, len(innerHits.Hits.Hits))
+		for _, h := range innerHits.Hits.Hits {
+			item, err := client.ParseDoc(h.Source, fields)
+			if err != nil {
+				return res, err
+			}
+			acl.mask(item)
+			items = append(items, item)
+		}
+		res["items"] = items
+	}
+
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+)
+
+// Count 只返回命中总数，请求格式与/content一致，分页、排序、高亮、聚合等参数会被忽略
+func (c *ContentController) Count() {
+	var err error
+	res := make(map[string]interface{})
+
+	c.prepare("count", "content_info", res)
+
+	q, err := c.compileQuery(&c.Param.Req)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+
+	searchlog := querySource(q)
+	total, errEs := c.esClient.Client.Count(c.esIndex).Type(c.esType).Preference("_primary_first").Query(q).Do(context.TODO())
+	if errEs != nil {
+		G_logger.Logger().Warn(searchlog)
+		c.outMsg(-1, searchlog, res)
+	}
+	G_logger.Logger().Info(searchlog)
+
+	res["total"] = total
+
+	if c.nc == "yes" {
+		bdata := c.setCache(c.cacheName, c.cacheKey, res)
+		c.AppendCtx(fmt.Sprintf("reqdata=[%s]", bdata))
+	}
+
+	c.outMsg(0, "OK", res)
+}
+
+// Exists 判断是否存在命中，每个分片找到第一条即停止
+func (c *ContentController) Exists() {
+	var err error
+	res := make(map[string]interface{})
+
+	c.prepare("exists", "content_info", res)
+
+	q, err := c.compileQuery(&c.Param.Req)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+
+	searchlog := querySource(q)
+	resEs, errEs := c.esClient.Client.Search().Index(c.esIndex).Type(c.esType).Preference("_primary_first").Timeout("1s").
+		Query(q).Size(0).TerminateAfter(1).Do(context.TODO())
+	if errEs != nil {
+		G_logger.Logger().Warn(searchlog)
+		c.outMsg(-1, searchlog, res)
+	}
+	G_logger.Logger().Info(searchlog)
+
+	res["exists"] = resEs.Hits.TotalHits > 0
+
+	if c.nc == "yes" {
+		bdata := c.setCache(c.cacheName, c.cacheKey, res)
+		c.AppendCtx(fmt.Sprintf("reqdata=[%s]", bdata))
+	}
+
+	c.outMsg(0, "OK", res)
+}
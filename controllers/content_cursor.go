@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	// 首次以游标方式翻页时传入
+	CURSOR_START = "start"
+
+	// 保证排序稳定的唯一字段
+	CURSOR_TIEBREAKER = "_id"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursorSecret 游标签名的密钥，为nil时不允许游标翻页
+var cursorSecret []byte
+
+// loadCursorSecret 未配置或仍为占位符xxxx时关闭游标翻页，其他功能不受影响
+func loadCursorSecret() []byte {
+	secret := G_conf.String("content::cursorSecret")
+	if secret == "" || secret == "xxxx" {
+		G_logger.Logger().Warn("content::cursorSecret is not configured, cursor paging is disabled")
+		return nil
+	}
+	return []byte(secret)
+}
+
+// encodeCursor 将最后一条命中的sort值编码为带签名的游标，scope用于限定游标只能被同一调用方使用
+func encodeCursor(sortValues []interface{}, scope string) (string, error) {
+	payload, err := json.Marshal(sortValues)
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(payload)
+	sign := base64.RawURLEncoding.EncodeToString(signCursor(data, scope))
+
+	return data + "." + sign, nil
+}
+
+// decodeCursor 校验游标签名并还原sort值
+func decodeCursor(cursor, scope string) ([]interface{}, error) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if !hmac.Equal(sign, signCursor(parts[0], scope)) {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// UseNumber避免long型的sort值精度丢失
+	var sortValues []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	err = decoder.Decode(&sortValues)
+	if err != nil || len(sortValues) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return sortValues, nil
+}
+
+func signCursor(data, scope string) []byte {
+	mac := hmac.New(sha256.New, cursorSecret)
+	mac.Write([]byte(scope))
+	mac.Write([]byte("|"))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
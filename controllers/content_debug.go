@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"time"
+)
+
+// contentDebug 调试模式下收集的信息，仅内部来源可用，见content::debugSources
+type contentDebug struct {
+	query       interface{}
+	profile     interface{}
+	cacheKey    string
+	cacheStatus string
+	shareURL    string
+	timings     map[string]float64
+}
+
+func newContentDebug() *contentDebug {
+	return &contentDebug{
+		cacheStatus: "disabled",
+		timings:     make(map[string]float64),
+	}
+}
+
+// timing 记录某阶段的耗时，单位毫秒
+func (d *contentDebug) timing(phase string, cost time.Duration) {
+	d.timings[phase] = float64(cost.Nanoseconds()) / 1e6
+}
+
+func (d *contentDebug) output() map[string]interface{} {
+	return map[string]interface{}{
+		"query":        d.query,
+		"profile":      d.profile,
+		"cache_key":    d.cacheKey,
+		"cache_status": d.cacheStatus,
+		"share_url":    d.shareURL,
+		"timings":      d.timings,
+	}
+}
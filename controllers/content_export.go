@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"beego_framework/common"
+
+	ec "beego_framework/common/elastic"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	EXPORT_FORMAT_NDJSON = "ndjson"
+	EXPORT_FORMAT_CSV    = "csv"
+
+	DEFAULT_EXPORT_RATE        = 1
+	DEFAULT_EXPORT_CONCURRENCY = 2
+	DEFAULT_EXPORT_MAX_ROWS    = 100000
+	DEFAULT_EXPORT_BATCH_SIZE  = 500
+
+	EXPORT_KEEP_ALIVE = "1m"
+)
+
+var (
+	exportQuotas   = make(map[string]*exportQuota)
+	exportQuotasMu sync.Mutex
+)
+
+// exportQuota 一个来源的导出限额，limiter限制每秒开始的导出次数，running限制同时进行的导出数，为nil时不限制
+type exportQuota struct {
+	limiter common.Limiter
+	running chan struct{}
+}
+
+// exportAllowed 只有配置中出现过的来源可以导出：content::exportSources、[content_secret]或字段权限中的来源，
+// 每个来源单独限额，限额不会随任意的来源名增加
+func exportAllowed(source string) bool {
+	return inSourceList("content::exportSources", source) ||
+		G_conf.String("content_secret::"+source) != "" ||
+		G_acl.HasSource(source)
+}
+
+// loadExportQuota 每秒最多content::exportRate次导出，同时最多content::exportConcurrency个导出，配置为0时不限制
+func loadExportQuota(source string) *exportQuota {
+	exportQuotasMu.Lock()
+	defer exportQuotasMu.Unlock()
+
+	q, ok := exportQuotas[source]
+	if !ok {
+		q = &exportQuota{
+			limiter: common.NewLeakyBucketLimiter(int64(G_conf.DefaultInt("content::exportRate", DEFAULT_EXPORT_RATE))),
+		}
+		if n := G_conf.DefaultInt("content::exportConcurrency", DEFAULT_EXPORT_CONCURRENCY); n > 0 {
+			q.running = make(chan struct{}, n)
+		}
+		exportQuotas[source] = q
+	}
+	return q
+}
+
+// acquire 成功后导出结束时需要调用release
+func (q *exportQuota) acquire() bool {
+	if q.limiter != nil && !q.limiter.Acquire() {
+		return false
+	}
+	if q.running == nil {
+		return true
+	}
+	select {
+	case q.running <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *exportQuota) release() {
+	if q.running != nil {
+		<-q.running
+	}
+}
+
+// exportFormat format参数优先，其次按Accept头选择，默认ndjson
+func exportFormat(format, accept string) string {
+	switch format {
+	case EXPORT_FORMAT_CSV, EXPORT_FORMAT_NDJSON:
+		return format
+	}
+	if strings.Contains(accept, "text/csv") {
+		return EXPORT_FORMAT_CSV
+	}
+	return EXPORT_FORMAT_NDJSON
+}
+
+// Export 通过scroll导出全部命中，请求体与/content一致，分页、高亮、聚合等参数会被忽略
+// 每批结果写出后立即flush，返回行数不超过content::exportMaxRows
+func (c *ContentController) Export() {
+	var err error
+	res := make(map[string]interface{})
+
+	body, err := c.readParam()
+	if err != nil {
+		c.outMsg(-1, err.Error(), errorData(err))
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(body)))
+	route := c.checkParamRoute(res)
+
+	source := c.Param.Req.Basic.Source
+	if !exportAllowed(source) {
+		var errs ValidationErrors
+		errs.add("req.basic.source", ERR_CODE_FORBIDDEN, "source is not allowed to export")
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+	quota := loadExportQuota(source)
+	if !quota.acquire() {
+		c.outMsg(-1, "export is busy", res)
+	}
+	defer quota.release()
+
+	format := exportFormat(c.GetString("format"), c.Ctx.Input.Header("Accept"))
+	if format == EXPORT_FORMAT_CSV {
+		var errs ValidationErrors
+		if len(c.Param.Res) == 0 {
+			errs.add("res", ERR_CODE_REQUIRED, "res is required for csv")
+		}
+		for _, field := range c.Param.Res {
+			if strings.Contains(field, "*") {
+				errs.add("res", ERR_CODE_INVALID_VALUE, "wildcard is not supported for csv")
+				break
+			}
+		}
+		if len(errs) > 0 {
+			c.outMsg(-1, errs.Error(), errorData(errs))
+		}
+	}
+	maxRows := G_conf.DefaultInt("content::exportMaxRows", DEFAULT_EXPORT_MAX_ROWS)
+	batchSize := G_conf.DefaultInt("content::exportBatchSize", DEFAULT_EXPORT_BATCH_SIZE)
+
+	q, err := c.compileQuery(&c.Param.Req)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	ss := elastic.NewSearchSource().Query(q).Size(batchSize).FetchSourceContext(ec.NewFetchSourceContext(c.Param.Res))
+	basic := &c.Param.Req.Basic
+	if basic.Sort != "" && basic.Desc != "" {
+		ss, _, err = parseSort(ss, basic)
+		if err != nil {
+			c.outMsg(-1, err.Error(), res)
+		}
+	} else {
+		ss = ss.Sort("_doc", true)
+	}
+
+	searchlog := querySource(q)
+	scroll := c.esClient.Client.Scroll(route.Index).Type(route.Type).KeepAlive(EXPORT_KEEP_ALIVE).SearchSource(ss)
+	defer scroll.Clear(context.Background())
+	resEs, errEs := scroll.Do(context.TODO())
+	if errEs != nil && errEs != io.EOF {
+		G_logger.Logger().Warn(searchlog)
+		c.outMsg(-1, searchlog, res)
+	}
+	G_logger.Logger().Info(searchlog)
+
+	var total int64
+	if resEs != nil && resEs.Hits != nil {
+		total = resEs.Hits.TotalHits
+	}
+	rows := total
+	if rows > int64(maxRows) {
+		rows = int64(maxRows)
+	}
+
+	w := c.Ctx.ResponseWriter
+	exp := newContentExporter(format, w, c.Param.Res)
+	c.Ctx.Output.Header("Content-Type", exp.contentType())
+	c.Ctx.Output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=content_%d.%s", c.IBiz, format))
+	c.Ctx.Output.Header("X-Total-Hits", strconv.FormatInt(total, 10))
+	c.Ctx.Output.Header("X-Export-Rows", strconv.FormatInt(rows, 10))
+	w.WriteHeader(200)
+
+	// 响应头已写出，之后的错误只记录日志，客户端通过X-Export-Rows判断是否完整
+	count := 0
+	acl := G_acl.Lookup(c.IBiz, c.Param.Req.Basic.Source)
+	err = exp.begin()
+	for err == nil && resEs != nil && count < maxRows {
+		for _, hit := range resEs.Hits.Hits {
+			if count >= maxRows {
+				break
+			}
+			var item map[string]interface{}
+			item, err = c.esClient.ParseDoc(hit.Source, c.Param.Res)
+			if err != nil {
+				break
+			}
+			acl.mask(item)
+			item["_id"] = hit.Id
+			err = exp.write(item)
+			if err != nil {
+				break
+			}
+			count++
+		}
+		if err == nil {
+			err = exp.flush()
+		}
+		w.Flush()
+		if err != nil || count >= maxRows {
+			break
+		}
+		resEs, err = scroll.Do(context.TODO())
+		if err == io.EOF {
+			err = nil
+			break
+		}
+	}
+	if err != nil {
+		G_logger.Logger().Warn(fmt.Sprintf("export failed. err: %s, rows: %d", err.Error(), count))
+		c.AppendCtx(fmt.Sprintf("export.err=%s", err.Error()))
+	}
+	c.AppendCtx(fmt.Sprintf("export.rows=%d", count))
+}
+
+// contentExporter 导出格式
+type contentExporter interface {
+	contentType() string
+	begin() error
+	write(item map[string]interface{}) error
+	flush() error
+}
+
+func newContentExporter(format string, w io.Writer, fields []string) contentExporter {
+	if format == EXPORT_FORMAT_CSV {
+		return &csvExporter{w: csv.NewWriter(w), fields: fields}
+	}
+	return &ndjsonExporter{enc: json.NewEncoder(w)}
+}
+
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExporter) contentType() string {
+	return "application/x-ndjson; charset=utf-8"
+}
+
+func (e *ndjsonExporter) begin() error {
+	return nil
+}
+
+func (e *ndjsonExporter) write(item map[string]interface{}) error {
+	return e.enc.Encode(item)
+}
+
+func (e *ndjsonExporter) flush() error {
+	return nil
+}
+
+// csvExporter 首行为_id与res中的字段，嵌套的对象与数组按json输出
+type csvExporter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (e *csvExporter) contentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write(append([]string{"_id"}, e.fields...))
+}
+
+func (e *csvExporter) write(item map[string]interface{}) error {
+	record := make([]string, 0, len(e.fields)+1)
+	record = append(record, fmt.Sprint(item["_id"]))
+	for _, field := range e.fields {
+		value, err := csvValue(item, field)
+		if err != nil {
+			return err
+		}
+		record = append(record, value)
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExporter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvValue 按路径取值，见ec.ResolveField，路径中间的值不是对象时输出空；匹配到多个值时输出json数组
+func csvValue(item map[string]interface{}, field string) (string, error) {
+	values := ec.ResolveField(item, field)
+	var value interface{}
+	switch len(values) {
+	case 0:
+		return "", nil
+	case 1:
+		value = values[0].Value
+	default:
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v.Value
+		}
+		value = list
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	bdata, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(bdata), nil
+}
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	GET_SOURCE_ES    = "es"
+	GET_SOURCE_MYSQL = "mysql"
+
+	MAX_MGET_SIZE = 100
+)
+
+var ErrContentNotFound = errors.New("content not found")
+
+// baseInfoKey content_base_info的key，载入函数通过key找到集群、索引与类型
+func baseInfoKey(route *ContentRoute, id string) string {
+	return fmt.Sprintf("%s|%s|%s|%s", route.Cluster, route.Index, route.Type, id)
+}
+
+// loadContentBaseInfo content_base_info的载入函数，返回文档的json
+// 配置content::getSource为mysql时从mysql读取，否则从es读取
+func loadContentBaseInfo(ctx context.Context, key string) (string, error) {
+	parts := strings.SplitN(key, "|", 4)
+	if len(parts) != 4 {
+		return "", errors.New("invalid key: " + key)
+	}
+	if G_conf.DefaultString("content::getSource", GET_SOURCE_ES) == GET_SOURCE_MYSQL {
+		return loadContentFromMysql(ctx, parts[3])
+	}
+
+	client, ok := G_ec[parts[0]]
+	if !ok {
+		return "", errors.New("invalid cluster: " + parts[0])
+	}
+	result, err := client.Client.Get().Index(parts[1]).Type(parts[2]).Id(parts[3]).Preference("_primary_first").Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", ErrContentNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !result.Found || result.Source == nil {
+		return "", ErrContentNotFound
+	}
+
+	return string(*result.Source), nil
+}
+
+func loadContentFromMysql(ctx context.Context, id string) (string, error) {
+	m, ok := G_mc[G_conf.String("content::getMysql")]
+	if !ok {
+		return "", errors.New("invalid get mysql")
+	}
+	table := G_conf.DefaultString("content::getTable", "tbNewsBaseInfo")
+	column := G_conf.DefaultString("content::getIdColumn", "iDocID")
+	rows, err := m.QueryString(ctx, fmt.Sprintf("select * from %s where %s = ? limit 1", table, column), id)
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 {
+		return "", ErrContentNotFound
+	}
+	bdata, err := json.Marshal(rows[0])
+	if err != nil {
+		return "", err
+	}
+
+	return string(bdata), nil
+}
+
+// GetById 按id获取单个文档，GET /content/:id?ibiz=&source=&t=&sign=&res=a,b
+func (c *ContentController) GetById() {
+	res := make(map[string]interface{})
+
+	c.Param.Req.Basic = CCBasic{
+		IBiz:      c.GetString("ibiz"),
+		Source:    c.GetString("source"),
+		Timestamp: c.GetString("t"),
+		Sign:      c.GetString("sign"),
+	}
+	if r := c.GetString("res"); r != "" {
+		c.Param.Res = strings.Split(r, ",")
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", c.Ctx.Input.URI()))
+
+	id := c.Ctx.Input.Param(":id")
+	if id == "" {
+		c.outMsg(-1, "invalid id", res)
+	}
+	route := c.checkParamRoute(res)
+
+	items, notFound, err := c.getContents(route, []string{id})
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	res["item"] = nil
+	if len(items) > 0 {
+		res["item"] = items[0]
+	}
+	res["not_found"] = notFound
+
+	c.outMsg(0, "OK", res)
+}
+
+// MGet 按id批量获取文档，请求体与/content一致，id列表放在req.ids
+func (c *ContentController) MGet() {
+	var err error
+	res := make(map[string]interface{})
+
+	err = json.Unmarshal(c.Ctx.Input.RequestBody, &c.Param)
+	if err != nil {
+		c.outMsg(-1, "invalid post data. err: "+err.Error(), res)
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(c.Ctx.Input.RequestBody)))
+
+	if len(c.Param.Req.Ids) == 0 || len(c.Param.Req.Ids) > MAX_MGET_SIZE {
+		c.outMsg(-1, fmt.Sprintf("invalid ids, max size is %d", MAX_MGET_SIZE), res)
+	}
+	route := c.checkParamRoute(res)
+
+	items, notFound, err := c.getContents(route, c.Param.Req.Ids)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	res["items"] = items
+	res["not_found"] = notFound
+
+	c.outMsg(0, "OK", res)
+}
+
+// checkParamRoute 校验参数与签名并找到路由，不查询缓存
+func (c *ContentController) checkParamRoute(res interface{}) *ContentRoute {
+	var err error
+
+	c.IBiz, c.template, err = c.checkParam(&c.Param)
+	if err != nil {
+		c.outMsg(-1, err.Error(), errorData(err))
+	}
+	route, err := G_router.Lookup(c.IBiz, c.Param.Req.Basic.Source)
+	if err != nil {
+		c.outMsg(-1, "invalid ibiz route", res)
+	}
+	c.esClient = G_ec[route.Cluster]
+
+	return route
+}
+
+// getContents 通过content_base_info读取文档，已缓存的直接返回，
+// 单个id由载入函数读取，多个id时未缓存的通过一次MultiGet读取后写入缓存
+func (c *ContentController) getContents(route *ContentRoute, ids []string) ([]map[string]interface{}, []string, error) {
+	cache := G_cache["content_base_info"]
+	docs := make(map[string]string, len(ids))
+	notFound := make([]string, 0)
+
+	var missing []string
+	for _, id := range ids {
+		if v, ok := cache.Peek(baseInfoKey(route, id)); ok {
+			docs[id] = v
+			continue
+		}
+		missing = append(missing, id)
+	}
+
+	if len(missing) == 1 || (len(missing) > 0 && G_conf.DefaultString("content::getSource", GET_SOURCE_ES) == GET_SOURCE_MYSQL) {
+		for _, id := range missing {
+			v, err := cache.GetContext(c.Ctx.Request.Context(), baseInfoKey(route, id))
+			if err == ErrContentNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			docs[id] = v
+		}
+	} else if len(missing) > 1 {
+		mget := c.esClient.Client.MultiGet().Preference("_primary_first")
+		for _, id := range missing {
+			mget = mget.Add(elastic.NewMultiGetItem().Index(route.Index).Type(route.Type).Id(id))
+		}
+		resEs, err := mget.Do(context.TODO())
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, doc := range resEs.Docs {
+			if doc == nil || !doc.Found || doc.Source == nil {
+				continue
+			}
+			docs[doc.Id] = string(*doc.Source)
+			cache.Set(baseInfoKey(route, doc.Id), docs[doc.Id])
+		}
+	}
+
+	acl := G_acl.Lookup(c.IBiz, c.Param.Req.Basic.Source)
+	items := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		v, ok := docs[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		source := json.RawMessage(v)
+		item, err := c.esClient.ParseDoc(&source, c.Param.Res)
+		if err != nil {
+			return nil, nil, errors.New("parse doc failed. err: " + err.Error())
+		}
+		acl.mask(item)
+		item["_id"] = id
+		items = append(items, item)
+	}
+
+	return items, notFound, nil
+}
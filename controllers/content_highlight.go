@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_HIGHLIGHT_FRAGMENT_SIZE = 1000
+	MAX_HIGHLIGHT_FRAGMENTS     = 10
+
+	DEFAULT_HIGHLIGHT_PRE_TAG  = "<em>"
+	DEFAULT_HIGHLIGHT_POST_TAG = "</em>"
+
+	// es返回的片段先用占位符标记，转义后再替换成请求的tag
+	HIGHLIGHT_PRE_MARK  = "@@kfhlpre@@"
+	HIGHLIGHT_POST_MARK = "@@kfhlpost@@"
+)
+
+// CCHighlight 高亮请求
+type CCHighlight struct {
+	Fields       []string `json:"fields"`
+	FragmentSize string   `json:"fragment_size"`
+	Number       string   `json:"number"`
+	PreTag       string   `json:"pre_tag"`
+	PostTag      string   `json:"post_tag"`
+}
+
+func (c *ContentController) parseHighlight(ss *elastic.SearchSource, hl CCHighlight) (*elastic.SearchSource, error) {
+	h := elastic.NewHighlight().PreTags(HIGHLIGHT_PRE_MARK).PostTags(HIGHLIGHT_POST_MARK)
+	for _, field := range hl.Fields {
+		if field == "" {
+			return ss, errors.New("invalid highlight field")
+		}
+		h = h.Fields(elastic.NewHighlighterField(field))
+	}
+	if hl.FragmentSize != "" {
+		size, err := strconv.Atoi(hl.FragmentSize)
+		if err != nil || size <= 0 || size > MAX_HIGHLIGHT_FRAGMENT_SIZE {
+			return ss, errors.New("invalid highlight fragment_size: " + hl.FragmentSize)
+		}
+		h = h.FragmentSize(size)
+	}
+	if hl.Number != "" {
+		number, err := strconv.Atoi(hl.Number)
+		if err != nil || number < 0 || number > MAX_HIGHLIGHT_FRAGMENTS {
+			return ss, errors.New("invalid highlight number: " + hl.Number)
+		}
+		h = h.NumOfFragments(number)
+	}
+
+	return ss.Highlight(h), nil
+}
+
+// parseHighlightResult 对片段做与Escape相同的转义，再换上请求的tag
+func (c *ContentController) parseHighlightResult(highlight elastic.SearchHitHighlight, hl CCHighlight) map[string][]string {
+	preTag := DEFAULT_HIGHLIGHT_PRE_TAG
+	if hl.PreTag != "" {
+		preTag = hl.PreTag
+	}
+	postTag := DEFAULT_HIGHLIGHT_POST_TAG
+	if hl.PostTag != "" {
+		postTag = hl.PostTag
+	}
+
+	res := make(map[string][]string)
+	for field, fragments := range highlight {
+		var items []string
+		for _, fragment := range fragments {
+			fragment = c.Escape(fragment)
+			fragment = strings.Replace(fragment, HIGHLIGHT_PRE_MARK, preTag, -1)
+			fragment = strings.Replace(fragment, HIGHLIGHT_POST_MARK, postTag, -1)
+			items = append(items, fragment)
+		}
+		res[field] = items
+	}
+
+	return res
+}
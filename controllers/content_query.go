@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	DEFAULT_QUERY_DEPTH = 5
+)
+
+// CCQueryNode 可递归嵌套的bool查询节点
+// need/range/match为叶子条件，与must中的写法一致，同一节点内的叶子条件之间为and关系
+// 例如 (A and (B or C)) or not D:
+// {"should": [{"must": [A, {"should": [B, C]}]}, {"must_not": [D]}]}
+type CCQueryNode struct {
+	Need  map[string]string `json:"need"`
+	Range map[string]string `json:"range"`
+	Match map[string]string `json:"match"`
+
+	Must               []CCQueryNode `json:"must"`
+	Should             []CCQueryNode `json:"should"`
+	MustNot            []CCQueryNode `json:"must_not"`
+	Filter             []CCQueryNode `json:"filter"`
+	MinimumShouldMatch string        `json:"minimum_should_match"`
+}
+
+func (c *ContentController) parseQuery(q *elastic.BoolQuery, node *CCQueryNode) error {
+	maxDepth := G_conf.DefaultInt("content::maxQueryDepth", DEFAULT_QUERY_DEPTH)
+	qt, err := c.parseQueryNode(node, 1, maxDepth)
+	if err != nil {
+		return err
+	}
+	q = q.Must(qt)
+
+	return nil
+}
+
+func (c *ContentController) parseQueryNode(node *CCQueryNode, depth, maxDepth int) (*elastic.BoolQuery, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("query too deep, max depth is %d", maxDepth)
+	}
+
+	q := elastic.NewBoolQuery()
+	c.parseMustNeed(q, node.Need)
+	err := c.parseMustRange(q, node.Range)
+	if err != nil {
+		return nil, err
+	}
+	c.parseMustMatch(q, node.Match)
+
+	for i := range node.Must {
+		qt, err := c.parseQueryNode(&node.Must[i], depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Must(qt)
+	}
+	for i := range node.Filter {
+		qt, err := c.parseQueryNode(&node.Filter[i], depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Filter(qt)
+	}
+	for i := range node.MustNot {
+		qt, err := c.parseQueryNode(&node.MustNot[i], depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		q = q.MustNot(qt)
+	}
+	for i := range node.Should {
+		qt, err := c.parseQueryNode(&node.Should[i], depth+1, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Should(qt)
+	}
+
+	// 与must同级时es默认should可以一个都不满足，这里默认至少满足一个，保持or的语义
+	if node.MinimumShouldMatch != "" {
+		if len(node.Should) == 0 {
+			return nil, errors.New("minimum_should_match without should")
+		}
+		q = q.MinimumShouldMatch(node.MinimumShouldMatch)
+	} else if len(node.Should) > 0 {
+		q = q.MinimumShouldMatch("1")
+	}
+
+	return q, nil
+}
@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	RANGE_TYPE_TIME      = "T"
+	RANGE_TYPE_MILLIS    = "MS"
+	RANGE_TYPE_DATE      = "D"
+	RANGE_TYPE_NUMBER    = "N"
+	RANGE_TYPE_STRING    = "S"
+	RANGE_BOUNDS_DEFAULT = "[]"
+
+	RANGE_TIME_LAYOUT = "2006-01-02 15:04:05"
+	RANGE_TIME_FORMAT = "yyyy-MM-dd HH:mm:ss"
+)
+
+// ccRange 解析后的范围条件，格式为 start|end|type[|bounds[|timezone]]
+// start、end为空表示该端不限
+// type: T为秒级时间戳，按时区格式化为yyyy-MM-dd HH:mm:ss；MS为毫秒时间戳；
+// D为es日期或日期运算，如now-7d/d、2020-01-01||+1M；N为数值；S为字符串
+// bounds: []、[)、(]、()，方括号包含边界，圆括号不包含，默认[]
+// timezone: 仅T和D可用，如+08:00、Asia/Shanghai，T默认使用服务器时区
+type ccRange struct {
+	from         interface{}
+	to           interface{}
+	includeLower bool
+	includeUpper bool
+	format       string
+	timeZone     string
+}
+
+func parseRange(value string) (*ccRange, error) {
+	parts := strings.Split(value, "|")
+	if len(parts) < 3 || len(parts) > 5 {
+		return nil, errors.New("range must be start|end|type[|bounds[|timezone]]")
+	}
+	if parts[0] == "" && parts[1] == "" {
+		return nil, errors.New("range needs start or end")
+	}
+
+	r := &ccRange{includeLower: true, includeUpper: true}
+	if len(parts) > 3 && parts[3] != "" {
+		bounds := parts[3]
+		if len(bounds) != 2 || (bounds[0] != '[' && bounds[0] != '(') || (bounds[1] != ']' && bounds[1] != ')') {
+			return nil, errors.New("bounds must be one of [] [) (] ()")
+		}
+		r.includeLower = bounds[0] == '['
+		r.includeUpper = bounds[1] == ']'
+	}
+	tz := ""
+	if len(parts) > 4 {
+		tz = parts[4]
+	}
+	if tz != "" && parts[2] != RANGE_TYPE_TIME && parts[2] != RANGE_TYPE_DATE {
+		return nil, errors.New("timezone is only supported by T and D")
+	}
+
+	switch parts[2] {
+	case RANGE_TYPE_TIME:
+		loc := time.Local
+		if tz != "" {
+			var err error
+			loc, err = loadRangeLocation(tz)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.format = RANGE_TIME_FORMAT
+		for i, name := range []string{"start", "end"} {
+			if parts[i] == "" {
+				continue
+			}
+			tt, err := strconv.ParseInt(parts[i], 10, 64)
+			if err != nil {
+				return nil, errors.New(name + " must be a unix timestamp")
+			}
+			r.set(i, time.Unix(tt, 0).In(loc).Format(RANGE_TIME_LAYOUT))
+		}
+	case RANGE_TYPE_MILLIS:
+		r.format = "epoch_millis"
+		for i, name := range []string{"start", "end"} {
+			if parts[i] == "" {
+				continue
+			}
+			tt, err := strconv.ParseInt(parts[i], 10, 64)
+			if err != nil {
+				return nil, errors.New(name + " must be a unix timestamp in milliseconds")
+			}
+			r.set(i, tt)
+		}
+	case RANGE_TYPE_DATE:
+		if tz != "" {
+			if _, err := loadRangeLocation(tz); err != nil {
+				return nil, err
+			}
+			r.timeZone = tz
+		}
+		for i := 0; i < 2; i++ {
+			if parts[i] != "" {
+				r.set(i, parts[i])
+			}
+		}
+	default:
+		for i := 0; i < 2; i++ {
+			if parts[i] != "" {
+				r.set(i, parts[i])
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func (r *ccRange) set(i int, v interface{}) {
+	if i == 0 {
+		r.from = v
+	} else {
+		r.to = v
+	}
+}
+
+// query 未设置的一端为null，es按不限处理
+func (r *ccRange) query(field string) *elastic.RangeQuery {
+	q := elastic.NewRangeQuery(field).From(r.from).To(r.to).IncludeLower(r.includeLower).IncludeUpper(r.includeUpper)
+	if r.format != "" {
+		q = q.Format(r.format)
+	}
+	if r.timeZone != "" {
+		q = q.TimeZone(r.timeZone)
+	}
+	return q
+}
+
+// loadRangeLocation 时区支持+08:00形式的偏移和IANA名称
+func loadRangeLocation(tz string) (*time.Location, error) {
+	if strings.HasPrefix(tz, "+") || strings.HasPrefix(tz, "-") {
+		t, err := time.Parse("-07:00", tz)
+		if err != nil {
+			return nil, errors.New("invalid timezone: " + tz)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(tz, offset), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New("invalid timezone: " + tz)
+	}
+	return loc, nil
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"go.uber.org/zap"
+)
+
+const (
+	ROUTE_SOURCE_CONF  = "conf"
+	ROUTE_SOURCE_MYSQL = "mysql"
+
+	DEFAULT_ROUTE_REFRESH = 60
+)
+
+var ErrRouteNotFound = errors.New("route not found")
+
+// ContentRoute ibiz(及source)对应的es集群、索引与类型
+type ContentRoute struct {
+	IBiz    int
+	Source  string // 为空表示该ibiz下的所有来源
+	Cluster string
+	Index   string
+	Type    string
+}
+
+// ContentRouter 路由表，支持从app.conf或mysql加载，并定时刷新
+//
+//	[content_route]
+//	; ibiz[.source] = cluster|index|type
+//	160 = yxs|yxs_gicp_index|contents
+//	160.wmp = yxs|yxs_wmp_alias|contents
+//
+//	create table tbContentRoute (
+//	    iBiz int, sSource varchar(64), sCluster varchar(64), sIndex varchar(128), sType varchar(64), iStatus int
+//	)
+type ContentRouter struct {
+	mu     sync.RWMutex
+	routes map[string]*ContentRoute
+}
+
+func NewContentRouter() *ContentRouter {
+	return &ContentRouter{
+		routes: make(map[string]*ContentRoute),
+	}
+}
+
+func routeKey(ibiz int, source string) string {
+	return fmt.Sprintf("%d|%s", ibiz, strings.ToLower(source))
+}
+
+// Lookup 优先匹配ibiz+source，其次匹配ibiz
+func (r *ContentRouter) Lookup(ibiz int, source string) (*ContentRoute, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if route, ok := r.routes[routeKey(ibiz, source)]; ok {
+		return route, nil
+	}
+	if route, ok := r.routes[routeKey(ibiz, "")]; ok {
+		return route, nil
+	}
+
+	return nil, ErrRouteNotFound
+}
+
+// Reload 重新加载路由表，加载失败时保留旧的路由表
+func (r *ContentRouter) Reload() error {
+	var routes []*ContentRoute
+	var err error
+
+	switch G_conf.DefaultString("content::routeSource", ROUTE_SOURCE_CONF) {
+	case ROUTE_SOURCE_MYSQL:
+		routes, err = loadRoutesFromMysql()
+	default:
+		routes, err = loadRoutesFromConf()
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]*ContentRoute, len(routes))
+	for _, route := range routes {
+		if _, ok := G_ec[route.Cluster]; !ok {
+			return fmt.Errorf("unknown cluster %s for ibiz %d", route.Cluster, route.IBiz)
+		}
+		data[routeKey(route.IBiz, route.Source)] = route
+	}
+
+	r.mu.Lock()
+	r.routes = data
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Refresh 定时刷新路由表
+func (r *ContentRouter) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := r.Reload()
+		if err != nil {
+			G_logger.Logger().Warn("reload content route failed", zap.Error(err))
+		}
+	}
+}
+
+// loadRoutesFromConf 每次重新读取配置文件，修改app.conf后无需重启
+func loadRoutesFromConf() ([]*ContentRoute, error) {
+	conf, err := config.NewConfig("ini", DEFAULT_CONF_PATH)
+	if err != nil {
+		return nil, err
+	}
+	section, err := conf.GetSection("content_route")
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*ContentRoute
+	for key, value := range section {
+		keys := strings.SplitN(key, ".", 2)
+		ibiz, err := strconv.Atoi(keys[0])
+		if err != nil {
+			return nil, errors.New("invalid route key: " + key)
+		}
+		parts := strings.Split(value, "|")
+		if len(parts) != 3 {
+			return nil, errors.New("invalid route: " + value)
+		}
+		route := &ContentRoute{
+			IBiz:    ibiz,
+			Cluster: parts[0],
+			Index:   parts[1],
+			Type:    parts[2],
+		}
+		if len(keys) == 2 {
+			route.Source = keys[1]
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+func loadRoutesFromMysql() ([]*ContentRoute, error) {
+	m, ok := G_mc[G_conf.String("content::routeMysql")]
+	if !ok {
+		return nil, errors.New("invalid route mysql")
+	}
+	table := G_conf.DefaultString("content::routeTable", "tbContentRoute")
+	rows, err := m.QueryString(context.Background(),
+		fmt.Sprintf("select iBiz,sSource,sCluster,sIndex,sType from %s where iStatus = 1", table))
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*ContentRoute
+	for _, row := range rows {
+		ibiz, err := strconv.Atoi(row["iBiz"])
+		if err != nil {
+			return nil, errors.New("invalid route ibiz: " + row["iBiz"])
+		}
+		routes = append(routes, &ContentRoute{
+			IBiz:    ibiz,
+			Source:  row["sSource"],
+			Cluster: row["sCluster"],
+			Index:   row["sIndex"],
+			Type:    row["sType"],
+		})
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"errors"
+	"strconv"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_SCORE_FUNCTIONS = 20
+)
+
+// CCScoreFunction 打分函数
+// type为gauss、exp、linear时使用field、origin、scale、offset、decay
+// type为field_value_factor时使用field、factor、modifier、missing
+// type为weight时只使用weight，一般配合filter给满足条件的文档加权
+type CCScoreFunction struct {
+	Type     string       `json:"type"`
+	Field    string       `json:"field"`
+	Origin   string       `json:"origin"`
+	Scale    string       `json:"scale"`
+	Offset   string       `json:"offset"`
+	Decay    string       `json:"decay"`
+	Factor   string       `json:"factor"`
+	Modifier string       `json:"modifier"`
+	Missing  string       `json:"missing"`
+	Weight   string       `json:"weight"`
+	Filter   *CCQueryNode `json:"filter"`
+}
+
+// CCScore 自定义打分，将查询包装为function_score
+type CCScore struct {
+	Functions []CCScoreFunction `json:"functions"`
+	BoostMode string            `json:"boost_mode"`
+	ScoreMode string            `json:"score_mode"`
+	MaxBoost  string            `json:"max_boost"`
+}
+
+var (
+	scoreBoostModes = map[string]bool{"multiply": true, "replace": true, "sum": true, "avg": true, "max": true, "min": true}
+	scoreScoreModes = map[string]bool{"multiply": true, "sum": true, "avg": true, "first": true, "max": true, "min": true}
+	scoreModifiers  = map[string]bool{"none": true, "log": true, "log1p": true, "log2p": true, "ln": true, "ln1p": true, "ln2p": true, "square": true, "sqrt": true, "reciprocal": true}
+)
+
+func (c *ContentController) parseScore(q elastic.Query, score CCScore) (elastic.Query, error) {
+	if len(score.Functions) > MAX_SCORE_FUNCTIONS {
+		return nil, errors.New("too many score functions, max is " + strconv.Itoa(MAX_SCORE_FUNCTIONS))
+	}
+
+	fsq := elastic.NewFunctionScoreQuery().Query(q)
+	for i, f := range score.Functions {
+		fn, err := buildScoreFunction(f)
+		if err != nil {
+			return nil, errors.New("functions[" + strconv.Itoa(i) + "]: " + err.Error())
+		}
+		if f.Filter != nil {
+			maxDepth := G_conf.DefaultInt("content::maxQueryDepth", DEFAULT_QUERY_DEPTH)
+			filter, err := c.parseQueryNode(f.Filter, 1, maxDepth)
+			if err != nil {
+				return nil, errors.New("functions[" + strconv.Itoa(i) + "].filter: " + err.Error())
+			}
+			fsq = fsq.Add(filter, fn)
+		} else {
+			fsq = fsq.AddScoreFunc(fn)
+		}
+	}
+
+	if score.BoostMode != "" {
+		if !scoreBoostModes[score.BoostMode] {
+			return nil, errors.New("invalid boost_mode: " + score.BoostMode)
+		}
+		fsq = fsq.BoostMode(score.BoostMode)
+	}
+	if score.ScoreMode != "" {
+		if !scoreScoreModes[score.ScoreMode] {
+			return nil, errors.New("invalid score_mode: " + score.ScoreMode)
+		}
+		fsq = fsq.ScoreMode(score.ScoreMode)
+	}
+	if score.MaxBoost != "" {
+		maxBoost, err := strconv.ParseFloat(score.MaxBoost, 64)
+		if err != nil {
+			return nil, errors.New("invalid max_boost: " + score.MaxBoost)
+		}
+		fsq = fsq.MaxBoost(maxBoost)
+	}
+
+	return fsq, nil
+}
+
+func buildScoreFunction(f CCScoreFunction) (elastic.ScoreFunction, error) {
+	var weight float64
+	var err error
+	if f.Weight != "" {
+		weight, err = strconv.ParseFloat(f.Weight, 64)
+		if err != nil {
+			return nil, errors.New("invalid weight: " + f.Weight)
+		}
+	}
+
+	switch f.Type {
+	case "gauss", "exp", "linear":
+		if f.Field == "" || f.Scale == "" {
+			return nil, errors.New("decay function requires field and scale")
+		}
+		var decay float64
+		if f.Decay != "" {
+			decay, err = strconv.ParseFloat(f.Decay, 64)
+			if err != nil || decay <= 0 || decay >= 1 {
+				return nil, errors.New("invalid decay: " + f.Decay)
+			}
+		}
+		switch f.Type {
+		case "gauss":
+			fn := elastic.NewGaussDecayFunction().FieldName(f.Field).Scale(f.Scale)
+			if f.Origin != "" {
+				fn = fn.Origin(f.Origin)
+			}
+			if f.Offset != "" {
+				fn = fn.Offset(f.Offset)
+			}
+			if f.Decay != "" {
+				fn = fn.Decay(decay)
+			}
+			if f.Weight != "" {
+				fn = fn.Weight(weight)
+			}
+			return fn, nil
+		case "exp":
+			fn := elastic.NewExponentialDecayFunction().FieldName(f.Field).Scale(f.Scale)
+			if f.Origin != "" {
+				fn = fn.Origin(f.Origin)
+			}
+			if f.Offset != "" {
+				fn = fn.Offset(f.Offset)
+			}
+			if f.Decay != "" {
+				fn = fn.Decay(decay)
+			}
+			if f.Weight != "" {
+				fn = fn.Weight(weight)
+			}
+			return fn, nil
+		default:
+			fn := elastic.NewLinearDecayFunction().FieldName(f.Field).Scale(f.Scale)
+			if f.Origin != "" {
+				fn = fn.Origin(f.Origin)
+			}
+			if f.Offset != "" {
+				fn = fn.Offset(f.Offset)
+			}
+			if f.Decay != "" {
+				fn = fn.Decay(decay)
+			}
+			if f.Weight != "" {
+				fn = fn.Weight(weight)
+			}
+			return fn, nil
+		}
+	case "field_value_factor":
+		if f.Field == "" {
+			return nil, errors.New("field_value_factor requires field")
+		}
+		fn := elastic.NewFieldValueFactorFunction().Field(f.Field)
+		if f.Factor != "" {
+			factor, err := strconv.ParseFloat(f.Factor, 64)
+			if err != nil {
+				return nil, errors.New("invalid factor: " + f.Factor)
+			}
+			fn = fn.Factor(factor)
+		}
+		if f.Modifier != "" {
+			if !scoreModifiers[f.Modifier] {
+				return nil, errors.New("invalid modifier: " + f.Modifier)
+			}
+			fn = fn.Modifier(f.Modifier)
+		}
+		if f.Missing != "" {
+			missing, err := strconv.ParseFloat(f.Missing, 64)
+			if err != nil {
+				return nil, errors.New("invalid missing: " + f.Missing)
+			}
+			fn = fn.Missing(missing)
+		}
+		if f.Weight != "" {
+			fn = fn.Weight(weight)
+		}
+		return fn, nil
+	case "weight":
+		if f.Weight == "" {
+			return nil, errors.New("weight function requires weight")
+		}
+		return elastic.NewWeightFactorFunction(weight), nil
+	}
+
+	return nil, errors.New("invalid function type: " + f.Type)
+}
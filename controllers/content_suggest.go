@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ec "beego_framework/common/elastic"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	SUGGEST_TYPE_COMPLETION = "completion"
+	SUGGEST_TYPE_PREFIX     = "prefix"
+
+	MAX_SUGGEST_SIZE     = 20
+	DEFAULT_SUGGEST_SIZE = 5
+
+	SUGGEST_NAME            = "suggest"
+	SUGGEST_CORRECTION_NAME = "correction"
+)
+
+// CCSuggest 联想词请求
+// type为completion时使用completion suggester，为prefix时对文本字段做前缀查询，并叠加must/must_not条件
+// fuzzy为yes时开启纠错，返回corrections
+type CCSuggest struct {
+	Text  string `json:"text"`
+	Type  string `json:"type"`
+	Size  string `json:"size"`
+	Fuzzy string `json:"fuzzy"`
+}
+
+// suggestConf 每个ibiz的联想字段，配置在[content_suggest]
+//
+//	[content_suggest]
+//	; ibiz = completion字段|文本字段
+//	160 = title_suggest|title
+type suggestConf struct {
+	completionField string
+	textField       string
+}
+
+func loadSuggestConf(ibiz int) (*suggestConf, error) {
+	value := G_conf.String(fmt.Sprintf("content_suggest::%d", ibiz))
+	parts := strings.Split(value, "|")
+	if len(parts) != 2 {
+		return nil, errors.New("suggest not configured for ibiz")
+	}
+	return &suggestConf{
+		completionField: parts[0],
+		textField:       parts[1],
+	}, nil
+}
+
+// suggestText 前缀查询命中的文本字段的值，按字段权限脱敏，多值字段取第一个
+func (c *ContentController) suggestText(source *json.RawMessage, field string, acl *ContentACL) (string, error) {
+	doc, err := c.esClient.ParseDoc(source, []string{field})
+	if err != nil {
+		return "", err
+	}
+	acl.mask(doc)
+	values := ec.ResolveField(doc, field)
+	if len(values) == 0 {
+		return "", nil
+	}
+	value := values[0].Value
+	if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+		value = arr[0]
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Suggest 搜索框联想，结果缓存在content_suggest中
+func (c *ContentController) Suggest() {
+	var err error
+	res := make(map[string]interface{})
+
+	c.prepare("suggest", "content_suggest", res)
+
+	sg := c.Param.Req.Suggest
+	var errs ValidationErrors
+	if sg.Text == "" {
+		errs.add("req.suggest.text", ERR_CODE_REQUIRED, "text is required")
+	}
+	if sg.Type != "" && sg.Type != SUGGEST_TYPE_COMPLETION && sg.Type != SUGGEST_TYPE_PREFIX {
+		errs.add("req.suggest.type", ERR_CODE_INVALID_VALUE, "type must be completion or prefix")
+	}
+	size := DEFAULT_SUGGEST_SIZE
+	if sg.Size != "" {
+		size, err = strconv.Atoi(sg.Size)
+		if err != nil || size <= 0 || size > MAX_SUGGEST_SIZE {
+			errs.add("req.suggest.size", ERR_CODE_INVALID_VALUE, fmt.Sprintf("size must be between 1 and %d", MAX_SUGGEST_SIZE))
+		}
+	}
+	if len(errs) > 0 {
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+
+	conf, err := loadSuggestConf(c.IBiz)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+
+	ss := elastic.NewSearchSource().Timeout("1s").FetchSourceContext(ec.NewFetchSourceContext(c.Param.Res))
+	if sg.Type == SUGGEST_TYPE_PREFIX {
+		// 联想词取自文本字段，res中没有时也要返回
+		ss = ss.FetchSourceContext(ec.NewFetchSourceContext(append([]string{conf.textField}, c.Param.Res...)))
+		q, err := c.compileQuery(&c.Param.Req)
+		if err != nil {
+			c.outMsg(-1, err.Error(), res)
+		}
+		q = q.Must(elastic.NewPrefixQuery(conf.textField, sg.Text))
+		ss = ss.Query(q).Size(size)
+	} else {
+		cs := elastic.NewCompletionSuggester(SUGGEST_NAME).Text(sg.Text).Field(conf.completionField).Size(size).SkipDuplicates(true)
+		if sg.Fuzzy == "yes" {
+			cs = cs.Fuzziness("AUTO")
+		}
+		ss = ss.Suggester(cs).Size(0)
+	}
+	if sg.Fuzzy == "yes" {
+		ss = ss.Suggester(elastic.NewPhraseSuggester(SUGGEST_CORRECTION_NAME).Text(sg.Text).Field(conf.textField).Size(1))
+	}
+
+	searchlog := querySource(ss)
+	resEs, errEs := c.esClient.Client.Search().Index(c.esIndex).Type(c.esType).Preference("_primary_first").SearchSource(ss).Do(context.TODO())
+	if errEs != nil {
+		G_logger.Logger().Warn(searchlog)
+		c.outMsg(-1, searchlog, res)
+	}
+	G_logger.Logger().Info(searchlog)
+
+	acl := G_acl.Lookup(c.IBiz, c.Param.Req.Basic.Source)
+	var items []map[string]interface{}
+	if sg.Type == SUGGEST_TYPE_PREFIX {
+		for _, hit := range resEs.Hits.Hits {
+			doc, err := c.esClient.ParseDoc(hit.Source, c.Param.Res)
+			if err != nil {
+				c.outMsg(-1, "parse doc failed. err: "+err.Error(), res)
+			}
+			acl.mask(doc)
+			text, err := c.suggestText(hit.Source, conf.textField, acl)
+			if err != nil {
+				c.outMsg(-1, "parse doc failed. err: "+err.Error(), res)
+			}
+			items = append(items, map[string]interface{}{
+				"text":  text,
+				"score": hit.Score,
+				"doc":   doc,
+			})
+		}
+	} else {
+		for _, suggestion := range resEs.Suggest[SUGGEST_NAME] {
+			for _, option := range suggestion.Options {
+				doc, err := c.esClient.ParseDoc(option.Source, c.Param.Res)
+				if err != nil {
+					c.outMsg(-1, "parse doc failed. err: "+err.Error(), res)
+				}
+				acl.mask(doc)
+				items = append(items, map[string]interface{}{
+					"text":  option.Text,
+					"score": option.ScoreUnderscore,
+					"doc":   doc,
+				})
+			}
+		}
+	}
+	res["items"] = items
+
+	if sg.Fuzzy == "yes" {
+		corrections := make([]string, 0)
+		for _, suggestion := range resEs.Suggest[SUGGEST_CORRECTION_NAME] {
+			for _, option := range suggestion.Options {
+				corrections = append(corrections, option.Text)
+			}
+		}
+		res["corrections"] = corrections
+	}
+
+	if c.nc == "yes" {
+		bdata := c.setCache(c.cacheName, c.cacheKey, res)
+		c.AppendCtx(fmt.Sprintf("reqdata=[%s]", bdata))
+	}
+
+	c.outMsg(0, "OK", res)
+}
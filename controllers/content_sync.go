@@ -0,0 +1,449 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	mc "beego_framework/common/mysql"
+	rc "beego_framework/common/redis"
+
+	"go.uber.org/zap"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MODULE_SCODE_SYNC        = 1001
+	MODULE_SCODE_SYNC_LAG    = -1003
+	MODULE_SCODE_SYNC_FAILED = -1004
+
+	DEFAULT_SYNC_BATCH_SIZE    = 500
+	DEFAULT_SYNC_INTERVAL      = 5
+	DEFAULT_SYNC_LAG_THRESHOLD = 300
+
+	SYNC_TIME_LAYOUT = "2006-01-02 15:04:05"
+)
+
+var syncColumnRegexp = regexp.MustCompile(`^\w+$`)
+
+var errSyncLockLost = errors.New("sync lock lost")
+
+const (
+	// 锁仍属于本机时续期
+	syncRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("EXPIRE", KEYS[1], ARGV[2]) end return 0`
+	// 锁仍属于本机时才推进水位线，避免失去锁后覆盖新持有者的水位线
+	syncWatermarkScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then redis.call("SET", KEYS[2], ARGV[2]) return 1 end return 0`
+)
+
+// syncColumn 列到文档字段的映射，typ为空时按字符串写入
+type syncColumn struct {
+	column string
+	field  string
+	typ    string
+}
+
+// ContentSyncer 将mysql表按更新时间增量同步到es，content::syncJobs中每个任务一个
+//
+//	[sync_news]
+//	ibiz = 160
+//	mysql = gicp3
+//	table = tbNewsBaseInfo
+//	idColumn = iDocID
+//	timeColumn = dtUpdateTime
+//	; 列名:字段名[:int|float]，多个用;分隔
+//	mapping = iDocID:id:int;sTitle:title;dtPubTime:pubtime
+//	; 可选，deleteColumn等于deleteValue的行从es删除
+//	deleteColumn = iStatus
+//	deleteValue = 0
+//	redis = wmp
+//
+// 水位线为最后同步的更新时间与id，保存在redis中，重启后从水位线继续；
+// 多台机器通过redis锁保证同一任务只有一台在同步，每批同步前续期，失去锁后不再推进水位线
+type ContentSyncer struct {
+	name         string
+	ibiz         int
+	mysql        *mc.Mysql
+	redis        *rc.Redis
+	table        string
+	idColumn     string
+	timeColumn   string
+	deleteColumn string
+	deleteValue  string
+	mapping      []syncColumn
+	batchSize    int
+	interval     time.Duration
+	lagThreshold time.Duration
+	owner        string
+}
+
+func NewContentSyncer(name string) (*ContentSyncer, error) {
+	section := "sync_" + name
+	s := &ContentSyncer{
+		name:         name,
+		table:        G_conf.String(section + "::table"),
+		idColumn:     G_conf.String(section + "::idColumn"),
+		timeColumn:   G_conf.String(section + "::timeColumn"),
+		deleteColumn: G_conf.String(section + "::deleteColumn"),
+		deleteValue:  G_conf.String(section + "::deleteValue"),
+		batchSize:    G_conf.DefaultInt(section+"::batchSize", DEFAULT_SYNC_BATCH_SIZE),
+		interval:     time.Duration(G_conf.DefaultInt(section+"::interval", DEFAULT_SYNC_INTERVAL)) * time.Second,
+		lagThreshold: time.Duration(G_conf.DefaultInt(section+"::lagThreshold", DEFAULT_SYNC_LAG_THRESHOLD)) * time.Second,
+	}
+
+	if s.interval < time.Second {
+		return nil, errors.New("invalid sync interval for " + name)
+	}
+	var err error
+	s.ibiz, err = strconv.Atoi(G_conf.String(section + "::ibiz"))
+	if err != nil {
+		return nil, errors.New("invalid sync ibiz for " + name)
+	}
+	var ok bool
+	if s.mysql, ok = G_mc[G_conf.String(section+"::mysql")]; !ok {
+		return nil, errors.New("invalid sync mysql for " + name)
+	}
+	if s.redis, ok = G_rc[G_conf.String(section+"::redis")]; !ok {
+		return nil, errors.New("invalid sync redis for " + name)
+	}
+	for _, column := range []string{s.table, s.idColumn, s.timeColumn} {
+		if !syncColumnRegexp.MatchString(column) {
+			return nil, errors.New("invalid sync table or column for " + name)
+		}
+	}
+	if s.deleteColumn != "" && !syncColumnRegexp.MatchString(s.deleteColumn) {
+		return nil, errors.New("invalid sync delete column for " + name)
+	}
+	for _, m := range G_conf.Strings(section + "::mapping") {
+		if m == "" {
+			continue
+		}
+		parts := strings.Split(m, ":")
+		if len(parts) < 2 || len(parts) > 3 || !syncColumnRegexp.MatchString(parts[0]) || parts[1] == "" {
+			return nil, errors.New("invalid sync mapping: " + m)
+		}
+		col := syncColumn{column: parts[0], field: parts[1]}
+		if len(parts) == 3 {
+			col.typ = parts[2]
+			if col.typ != "int" && col.typ != "float" {
+				return nil, errors.New("invalid sync mapping type: " + m)
+			}
+		}
+		s.mapping = append(s.mapping, col)
+	}
+	if len(s.mapping) == 0 {
+		return nil, errors.New("empty sync mapping for " + name)
+	}
+	hostname, _ := os.Hostname()
+	s.owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+
+	return s, nil
+}
+
+// Run 定时同步，每次把积压的数据同步完，每批之前续期同步锁，失去锁时停止
+// 有未完成的行时本轮停止，下一轮从水位线重试
+func (s *ContentSyncer) Run() {
+	for range time.Tick(s.interval) {
+		if !s.lock() {
+			continue
+		}
+		for {
+			n, err := s.sync()
+			if err != nil {
+				G_logger.Logger().Warn("content sync failed", zap.String("name", s.name), zap.Error(err))
+				s.reportFailure()
+				break
+			}
+			if n < s.batchSize {
+				break
+			}
+			if !s.renew() {
+				G_logger.Logger().Warn("content sync failed", zap.String("name", s.name), zap.Error(errSyncLockLost))
+				break
+			}
+		}
+	}
+}
+
+func (s *ContentSyncer) watermarkKey() string {
+	return "content_sync:" + s.name
+}
+
+func (s *ContentSyncer) lockKey() string {
+	return "content_sync_lock:" + s.name
+}
+
+// lockTTL 锁的有效期为三个同步周期
+func (s *ContentSyncer) lockTTL() int {
+	return int(s.interval/time.Second) * 3
+}
+
+// lock 抢占同步锁，已持有时续期
+func (s *ContentSyncer) lock() bool {
+	reply, err := s.redis.Do(context.Background(), "SET", s.lockKey(), s.owner, "NX", "EX", s.lockTTL())
+	if err != nil {
+		return false
+	}
+	if reply != nil {
+		return true
+	}
+	return s.renew()
+}
+
+// renew 锁仍属于本机时续期，比较与续期在同一个lua脚本中完成
+func (s *ContentSyncer) renew() bool {
+	n, err := s.redis.Int(s.redis.Do(context.Background(), "EVAL", syncRenewScript, 1, s.lockKey(), s.owner, s.lockTTL()))
+	return err == nil && n == 1
+}
+
+// watermark 返回最后同步的更新时间与id，没有水位线时从头同步
+func (s *ContentSyncer) watermark() (string, string, error) {
+	reply, err := s.redis.Do(context.Background(), "GET", s.watermarkKey())
+	if err != nil {
+		return "", "", err
+	}
+	if reply == nil {
+		return "", "", nil
+	}
+	value, err := s.redis.Bytes(reply, nil)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(string(value), "|", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("invalid watermark: " + string(value))
+	}
+	return parts[0], parts[1], nil
+}
+
+func (s *ContentSyncer) columns() string {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, column := range []string{s.idColumn, s.timeColumn, s.deleteColumn} {
+		if column != "" && !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+	for _, m := range s.mapping {
+		if !seen[m.column] {
+			seen[m.column] = true
+			columns = append(columns, m.column)
+		}
+	}
+	return strings.Join(columns, ",")
+}
+
+// sync 同步一批数据，水位线只推进到第一个未写入es的行之前，返回已完成的行数
+// 转换失败或es拒绝的行会在下一次同步时重试，修复数据之前该任务停在这一行，并按失败告警
+func (s *ContentSyncer) sync() (int, error) {
+	wmTime, wmId, err := s.watermark()
+	if err != nil {
+		return 0, err
+	}
+
+	var rows []map[string]string
+	if wmTime == "" {
+		rows, err = s.mysql.QueryString(context.Background(),
+			fmt.Sprintf("select %s from %s order by %s,%s limit ?", s.columns(), s.table, s.timeColumn, s.idColumn),
+			s.batchSize)
+	} else {
+		rows, err = s.mysql.QueryString(context.Background(),
+			fmt.Sprintf("select %s from %s where %s > ? or (%s = ? and %s > ?) order by %s,%s limit ?",
+				s.columns(), s.table, s.timeColumn, s.timeColumn, s.idColumn, s.timeColumn, s.idColumn),
+			wmTime, wmTime, wmId, s.batchSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		s.report(0, 0, 0)
+		return 0, nil
+	}
+
+	route, err := G_router.Lookup(s.ibiz, "")
+	if err != nil {
+		return 0, err
+	}
+	reqs := make([]elastic.BulkableRequest, len(rows))
+	ids := make([]string, 0, len(rows))
+	failed := 0
+	for i, row := range rows {
+		id := row[s.idColumn]
+		if s.deleteColumn != "" && row[s.deleteColumn] == s.deleteValue {
+			reqs[i] = elastic.NewBulkDeleteRequest().Index(route.Index).Type(route.Type).Id(id)
+			ids = append(ids, id)
+			continue
+		}
+		doc, err := s.mapRow(row)
+		if err != nil {
+			failed++
+			G_logger.Logger().Warn("content sync map row failed", zap.String("name", s.name), zap.String("id", id), zap.Error(err))
+			continue
+		}
+		reqs[i] = elastic.NewBulkIndexRequest().Index(route.Index).Type(route.Type).Id(id).Doc(doc)
+		ids = append(ids, id)
+	}
+	done := make([]bool, len(rows))
+	n, err := s.bulk(G_ec[route.Cluster].Client, reqs, done)
+	failed += n
+	if len(ids) > 0 {
+		// 同步是持续的，只清除文档缓存，搜索缓存按过期时间更新
+		invalidateDocs(route, ids)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	finished := 0
+	for finished < len(rows) && done[finished] {
+		finished++
+	}
+	if finished > 0 {
+		last := rows[finished-1]
+		wmTime = last[s.timeColumn]
+		n, err := s.redis.Int(s.redis.Do(context.Background(), "EVAL", syncWatermarkScript, 2,
+			s.lockKey(), s.watermarkKey(), s.owner, wmTime+"|"+last[s.idColumn]))
+		if err != nil {
+			return 0, err
+		}
+		if n != 1 {
+			return 0, errSyncLockLost
+		}
+	}
+
+	var lag time.Duration
+	if finished < len(rows) || len(rows) == s.batchSize {
+		lag = watermarkLag(wmTime)
+	}
+	s.report(lag, len(rows), failed)
+
+	return finished, nil
+}
+
+// bulk 提交reqs中不为nil的请求，单条返回408、429、503、507时重新提交，最多MAX_BULK_ITEM_RETRIES轮，与bulkWrite一致
+// 写入成功的在done中标记，返回失败的条数
+func (s *ContentSyncer) bulk(client *elastic.Client, reqs []elastic.BulkableRequest, done []bool) (int, error) {
+	var pending []int
+	for i, r := range reqs {
+		if r != nil {
+			pending = append(pending, i)
+		}
+	}
+
+	failed := 0
+	backoff := elastic.NewExponentialBackoff(100*time.Millisecond, 5*time.Second)
+	for retry := 0; len(pending) > 0; retry++ {
+		bulk := client.Bulk()
+		for _, i := range pending {
+			bulk = bulk.Add(reqs[i])
+		}
+		resEs, err := bulk.Do(context.Background())
+		if err != nil {
+			return failed, err
+		}
+
+		var retries []int
+		for n, i := range pending {
+			if n >= len(resEs.Items) {
+				failed++
+				continue
+			}
+			for _, item := range resEs.Items[n] {
+				// 删除不存在的文档返回404，没有error
+				if item.Error == nil {
+					done[i] = true
+					continue
+				}
+				if bulkRetryStatus[item.Status] && retry < MAX_BULK_ITEM_RETRIES {
+					retries = append(retries, i)
+					continue
+				}
+				failed++
+				G_logger.Logger().Warn("content sync index failed", zap.String("name", s.name), zap.String("id", item.Id), zap.String("reason", item.Error.Reason))
+			}
+		}
+
+		pending = retries
+		if len(pending) > 0 {
+			wait, _ := backoff.Next(retry)
+			time.Sleep(wait)
+		}
+	}
+
+	return failed, nil
+}
+
+// watermarkLag 水位线距今的时间，没有水位线时为0
+func watermarkLag(wmTime string) time.Duration {
+	if wmTime == "" {
+		return 0
+	}
+	return time.Since(syncTime(wmTime))
+}
+
+func (s *ContentSyncer) mapRow(row map[string]string) (map[string]interface{}, error) {
+	doc := make(map[string]interface{}, len(s.mapping))
+	for _, m := range s.mapping {
+		value, ok := row[m.column]
+		if !ok {
+			continue
+		}
+		switch m.typ {
+		case "int":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid int column " + m.column + ": " + value)
+			}
+			doc[m.field] = n
+		case "float":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, errors.New("invalid float column " + m.column + ": " + value)
+			}
+			doc[m.field] = f
+		default:
+			doc[m.field] = value
+		}
+	}
+	return doc, nil
+}
+
+// syncTime 更新时间列支持datetime与秒级时间戳
+func syncTime(value string) time.Time {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(n, 0)
+	}
+	t, err := time.ParseInLocation(SYNC_TIME_LAYOUT, value, time.Local)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// reportFailure 同步失败时按保存的水位线上报延迟，mysql或es故障期间延迟照常更新并告警
+func (s *ContentSyncer) reportFailure() {
+	wmTime, _, _ := s.watermark()
+	s.report(watermarkLag(wmTime), 0, 1)
+}
+
+// report 上报同步延迟，lag为最后同步的数据距今的时间，已追平时为0，超过lagThreshold或有失败时告警
+func (s *ContentSyncer) report(lag time.Duration, rows, failed int) {
+	scode := MODULE_SCODE_SYNC
+	if failed > 0 {
+		scode = MODULE_SCODE_SYNC_FAILED
+	} else if lag > s.lagThreshold {
+		scode = MODULE_SCODE_SYNC_LAG
+	}
+	G_logger.Logger().Info("content sync",
+		zap.String("name", s.name),
+		zap.Int64("lag", int64(lag/time.Second)),
+		zap.Int("rows", rows),
+		zap.Int("failed", failed),
+		zap.Int("code", MODULE_CODE),
+		zap.Int("scode", scode))
+}
@@ -0,0 +1,344 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+
+	mc "beego_framework/common/mysql"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+
+	templateNameRegexp        = regexp.MustCompile(`^[a-zA-Z0-9_]{1,64}$`)
+	templatePlaceholderRegexp = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+)
+
+// contentTemplate 保存的查询模板，body为CCReqParam的json，字符串与map的key中可使用{{param}}占位
+//
+//	create table tbContentTemplate (
+//	    sName varchar(64), iVersion int, sBody text, sOperator varchar(64), iStatus int, dtCreateTime datetime,
+//	    primary key (sName, iVersion)
+//	)
+//
+// 每个模板只有一个iStatus为1的版本生效
+type contentTemplate struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Body    string `json:"body"`
+}
+
+func templateMysql() (*mc.Mysql, string, error) {
+	m, ok := G_mc[G_conf.String("content::templateMysql")]
+	if !ok {
+		return nil, "", errors.New("invalid template mysql")
+	}
+	return m, G_conf.DefaultString("content::templateTable", "tbContentTemplate"), nil
+}
+
+// loadContentTemplate content_template的载入函数，返回生效版本的json
+func loadContentTemplate(ctx context.Context, name string) (string, error) {
+	m, table, err := templateMysql()
+	if err != nil {
+		return "", err
+	}
+	rows, err := m.QueryString(ctx,
+		fmt.Sprintf("select iVersion,sBody from %s where sName = ? and iStatus = 1 limit 1", table), name)
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 {
+		return "", ErrTemplateNotFound
+	}
+	version, err := strconv.Atoi(rows[0]["iVersion"])
+	if err != nil {
+		return "", errors.New("invalid template version: " + rows[0]["iVersion"])
+	}
+	bdata, err := json.Marshal(contentTemplate{Name: name, Version: version, Body: rows[0]["sBody"]})
+	if err != nil {
+		return "", err
+	}
+
+	return string(bdata), nil
+}
+
+// expandTemplate 用模板展开请求，返回模板版本，用于区分缓存
+// 查询条件全部来自模板，请求中只能有basic、template、params与ids；
+// 模板中的basic作为默认值，ibiz、source、t、sign总是使用请求中的值
+func expandTemplate(req *CCReqParam) (int, error) {
+	var errs ValidationErrors
+
+	if !templateNameRegexp.MatchString(req.Template) {
+		errs.add("req.template", ERR_CODE_INVALID_FORMAT, "template name must be 1-64 letters, digits or _")
+		return 0, errs
+	}
+
+	probe := *req
+	probe.Basic = CCBasic{}
+	probe.Template = ""
+	probe.Params = nil
+	probe.Ids = nil
+	if !reflect.DeepEqual(probe, CCReqParam{}) {
+		errs.add("req.template", ERR_CODE_CONFLICT, "query conditions can not be used with template")
+		return 0, errs
+	}
+
+	v, err := G_cache["content_template"].Get(req.Template)
+	if err == ErrTemplateNotFound {
+		errs.add("req.template", ERR_CODE_INVALID_VALUE, "template not found: "+req.Template)
+		return 0, errs
+	}
+	if err != nil {
+		return 0, err
+	}
+	var tpl contentTemplate
+	err = json.Unmarshal([]byte(v), &tpl)
+	if err != nil {
+		return 0, err
+	}
+
+	var body interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(tpl.Body)))
+	dec.UseNumber()
+	err = dec.Decode(&body)
+	if err != nil {
+		return 0, errors.New("invalid template body. err: " + err.Error())
+	}
+	body = expandPlaceholders(body, req.Params, &errs)
+	if len(errs) > 0 {
+		return 0, errs
+	}
+	bdata, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	var expanded CCReqParam
+	err = json.Unmarshal(bdata, &expanded)
+	if err != nil {
+		return 0, errors.New("invalid template body. err: " + err.Error())
+	}
+
+	basic := expanded.Basic
+	mergeBasic(&basic, &req.Basic)
+	expanded.Basic = basic
+	expanded.Template = req.Template
+	expanded.Params = req.Params
+	expanded.Ids = req.Ids
+	*req = expanded
+
+	return tpl.Version, nil
+}
+
+// mergeBasic 请求中非空的字段覆盖模板中的默认值
+func mergeBasic(dst, src *CCBasic) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < d.NumField(); i++ {
+		if s.Field(i).String() != "" {
+			d.Field(i).SetString(s.Field(i).String())
+		}
+	}
+	dst.IBiz = src.IBiz
+	dst.Source = src.Source
+	dst.Timestamp = src.Timestamp
+	dst.Sign = src.Sign
+}
+
+// expandPlaceholders 在解析后的json中替换占位符，参数值不会改变json结构
+func expandPlaceholders(v interface{}, params map[string]string, errs *ValidationErrors) interface{} {
+	switch t := v.(type) {
+	case string:
+		return templatePlaceholderRegexp.ReplaceAllStringFunc(t, func(s string) string {
+			name := templatePlaceholderRegexp.FindStringSubmatch(s)[1]
+			value, ok := params[name]
+			if !ok {
+				errs.add("req.params."+name, ERR_CODE_REQUIRED, "template param "+name+" is required")
+			}
+			return value
+		})
+	case []interface{}:
+		for i := range t {
+			t[i] = expandPlaceholders(t[i], params, errs)
+		}
+		return t
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			res[expandPlaceholders(key, params, errs).(string)] = expandPlaceholders(value, params, errs)
+		}
+		return res
+	}
+	return v
+}
+
+// CCTemplateParam 模板管理请求
+type CCTemplateParam struct {
+	Basic    CCBasic         `json:"basic"`
+	Name     string          `json:"name"`
+	Body     json.RawMessage `json:"body"`
+	Version  string          `json:"version"`
+	Activate string          `json:"activate"`
+	Operator string          `json:"operator"`
+}
+
+// TemplateController 查询模板管理，仅content::templateAdminSources中的来源可用
+type TemplateController struct {
+	AbstractController
+
+	Param CCTemplateParam
+}
+
+func (c *TemplateController) prepare(res interface{}) {
+	err := json.Unmarshal(c.Ctx.Input.RequestBody, &c.Param)
+	if err != nil {
+		c.outMsg(-1, "invalid post data. err: "+err.Error(), res)
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(c.Ctx.Input.RequestBody)))
+
+	// 与写入接口一样使用带密钥的签名
+	basic := &c.Param.Basic
+	var errs ValidationErrors
+	ibiz := validateIdentity("basic", basic, &errs)
+	if len(errs) == 0 {
+		errs = checkSecretSign("basic", basic, ibiz, c.Ctx.Input.Header(SIGN_HEADER), c.Ctx.Input.RequestBody)
+	}
+	if len(errs) == 0 && !inSourceList("content::templateAdminSources", basic.Source) {
+		errs.add("basic.source", ERR_CODE_FORBIDDEN, "source is not allowed to manage templates")
+	}
+	if len(errs) == 0 && !templateNameRegexp.MatchString(c.Param.Name) {
+		errs.add("name", ERR_CODE_INVALID_FORMAT, "template name must be 1-64 letters, digits or _")
+	}
+	if len(errs) > 0 {
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+}
+
+// Save 保存为新版本，activate为yes时同时生效
+func (c *TemplateController) Save() {
+	res := make(map[string]interface{})
+
+	c.prepare(res)
+
+	var req CCReqParam
+	err := json.Unmarshal(c.Param.Body, &req)
+	if err != nil {
+		c.outMsg(-1, "invalid template body. err: "+err.Error(), res)
+	}
+	if req.Template != "" {
+		c.outMsg(-1, "template can not reference another template", res)
+	}
+
+	m, table, err := templateMysql()
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	rows, err := m.QueryString(context.Background(),
+		fmt.Sprintf("select ifnull(max(iVersion), 0) as iVersion from %s where sName = ?", table), c.Param.Name)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	version := 1
+	if len(rows) > 0 {
+		last, _ := strconv.Atoi(rows[0]["iVersion"])
+		version = last + 1
+	}
+	// (sName, iVersion)为主键，并发保存同一模板时只有一个成功
+	_, err = m.Exec(context.Background(),
+		fmt.Sprintf("insert into %s (sName,iVersion,sBody,sOperator,iStatus,dtCreateTime) values (?,?,?,?,0,now())", table),
+		c.Param.Name, version, string(c.Param.Body), c.Param.Operator)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	if c.Param.Activate == "yes" {
+		err = activateTemplate(c.Param.Name, version)
+		if err != nil {
+			c.outMsg(-1, err.Error(), res)
+		}
+	}
+	res["name"] = c.Param.Name
+	res["version"] = version
+
+	c.outMsg(0, "OK", res)
+}
+
+// Activate 切换生效版本，可用于回滚
+func (c *TemplateController) Activate() {
+	res := make(map[string]interface{})
+
+	c.prepare(res)
+
+	version, err := strconv.Atoi(c.Param.Version)
+	if err != nil || version <= 0 {
+		c.outMsg(-1, "invalid version", res)
+	}
+	err = activateTemplate(c.Param.Name, version)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	res["name"] = c.Param.Name
+	res["version"] = version
+
+	c.outMsg(0, "OK", res)
+}
+
+// Versions 模板的全部版本
+func (c *TemplateController) Versions() {
+	res := make(map[string]interface{})
+
+	c.prepare(res)
+
+	m, table, err := templateMysql()
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	rows, err := m.QueryString(context.Background(),
+		fmt.Sprintf("select iVersion,sBody,sOperator,iStatus,dtCreateTime from %s where sName = ? order by iVersion desc", table), c.Param.Name)
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	versions := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		version, _ := strconv.Atoi(row["iVersion"])
+		versions = append(versions, map[string]interface{}{
+			"version":     version,
+			"body":        json.RawMessage(row["sBody"]),
+			"operator":    row["sOperator"],
+			"active":      row["iStatus"] == "1",
+			"create_time": row["dtCreateTime"],
+		})
+	}
+	res["name"] = c.Param.Name
+	res["versions"] = versions
+
+	c.outMsg(0, "OK", res)
+}
+
+// activateTemplate 生效指定版本并清除本机缓存，其他机器在content_template过期后生效
+func activateTemplate(name string, version int) error {
+	m, table, err := templateMysql()
+	if err != nil {
+		return err
+	}
+	rows, err := m.QueryString(context.Background(),
+		fmt.Sprintf("select iVersion from %s where sName = ? and iVersion = ?", table), name, version)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errors.New("template version not found")
+	}
+	_, err = m.Exec(context.Background(),
+		fmt.Sprintf("update %s set iStatus = if(iVersion = ?, 1, 0) where sName = ?", table), version, name)
+	if err != nil {
+		return err
+	}
+	G_cache["content_template"].Del(name)
+
+	return nil
+}
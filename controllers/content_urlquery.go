@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	URL_QUERY_PARAM     = "q"
+	MAX_URL_QUERY_INDEX = 100
+
+	DEFAULT_GET_MAX_AGE = 60
+)
+
+// readParam 解析请求参数到c.Param，返回请求体，用于日志与缓存key
+// POST读取请求体；GET支持两种形式：
+//
+//	?q=base64url(请求体json)，与POST同一请求体共享缓存
+//	?req.basic.ibiz=160&req.must.need.type=1&res=title&res=url，key为字段的json路径
+//
+// json路径中数组用[n]表示下标，[]string字段也可重复key依次追加；
+// map[string]string字段的key为剩余路径，如req.must.range.info.ctime
+// 模板在校验签名之后由checkParam展开
+func (c *ContentController) readParam() ([]byte, error) {
+	if !c.Ctx.Input.IsGet() {
+		body := c.Ctx.Input.RequestBody
+		if err := json.Unmarshal(body, &c.Param); err != nil {
+			return nil, errors.New("invalid post data. err: " + err.Error())
+		}
+		return body, nil
+	}
+
+	values := c.Ctx.Request.URL.Query()
+	if _, ok := values[URL_QUERY_PARAM]; ok {
+		if len(values) > 1 {
+			return nil, errors.New("q can not be used with other params")
+		}
+		body, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values.Get(URL_QUERY_PARAM), "="))
+		if err != nil {
+			return nil, errors.New("invalid q. err: " + err.Error())
+		}
+		if err := json.Unmarshal(body, &c.Param); err != nil {
+			return nil, errors.New("invalid q. err: " + err.Error())
+		}
+		return body, nil
+	}
+
+	if err := decodeURLQuery(values, &c.Param); err != nil {
+		return nil, err
+	}
+	return json.Marshal(c.Param)
+}
+
+// shareURL 调试时返回等价的GET地址，便于复现
+func shareURL(body []byte) string {
+	return "/content?" + URL_QUERY_PARAM + "=" + base64.RawURLEncoding.EncodeToString(body)
+}
+
+// setCacheControl GET请求允许cdn与浏览器缓存，调试模式除外
+func (c *ContentController) setCacheControl() {
+	if !c.Ctx.Input.IsGet() || c.debug != nil {
+		return
+	}
+	maxAge := G_conf.DefaultInt("content::getMaxAge", DEFAULT_GET_MAX_AGE)
+	c.Ctx.Output.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+}
+
+func decodeURLQuery(values url.Values, v interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := reflect.ValueOf(v).Elem()
+	for _, key := range keys {
+		for _, value := range values[key] {
+			if err := setURLQueryPath(root, strings.Split(key, "."), value); err != nil {
+				return errors.New("invalid param " + key + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func setURLQueryPath(v reflect.Value, path []string, value string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setURLQueryPath(v.Elem(), path, value)
+	case reflect.String:
+		if len(path) > 0 {
+			return errors.New("unknown field " + path[0])
+		}
+		v.SetString(value)
+		return nil
+	case reflect.Slice:
+		if len(path) > 0 || v.Type().Elem().Kind() != reflect.String {
+			return errors.New("index required")
+		}
+		v.Set(reflect.Append(v, reflect.ValueOf(value)))
+		return nil
+	case reflect.Map:
+		if len(path) == 0 {
+			return errors.New("key required")
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		if v.Type().Elem().Kind() == reflect.String {
+			key := reflect.ValueOf(strings.Join(path, "."))
+			if v.MapIndex(key).IsValid() {
+				return errors.New("duplicate value")
+			}
+			v.SetMapIndex(key, reflect.ValueOf(value))
+			return nil
+		}
+		key := reflect.ValueOf(path[0])
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if old := v.MapIndex(key); old.IsValid() {
+			elem.Set(old)
+		}
+		if err := setURLQueryPath(elem, path[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	case reflect.Struct:
+		if len(path) == 0 {
+			return errors.New("field required")
+		}
+		name, index, err := parseURLQuerySegment(path[0])
+		if err != nil {
+			return err
+		}
+		field, ok := jsonField(v, name)
+		if !ok {
+			return errors.New("unknown field " + name)
+		}
+		if index < 0 {
+			return setURLQueryPath(field, path[1:], value)
+		}
+		if field.Kind() != reflect.Slice {
+			return errors.New(name + " is not an array")
+		}
+		if index >= field.Len() {
+			field.Set(reflect.AppendSlice(field, reflect.MakeSlice(field.Type(), index+1-field.Len(), index+1-field.Len())))
+		}
+		return setURLQueryPath(field.Index(index), path[1:], value)
+	}
+
+	return errors.New("unsupported field")
+}
+
+// parseURLQuerySegment 解析should[0]形式的路径，没有下标时返回-1
+func parseURLQuerySegment(segment string) (string, int, error) {
+	i := strings.Index(segment, "[")
+	if i < 0 {
+		return segment, -1, nil
+	}
+	if !strings.HasSuffix(segment, "]") {
+		return "", 0, errors.New("invalid index " + segment)
+	}
+	index, err := strconv.Atoi(segment[i+1 : len(segment)-1])
+	if err != nil || index < 0 || index >= MAX_URL_QUERY_INDEX {
+		return "", 0, fmt.Errorf("index must be between 0 and %d", MAX_URL_QUERY_INDEX-1)
+	}
+	return segment[:i], index, nil
+}
+
+func jsonField(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" && tag == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"beego_framework/common"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	DEFAULT_SIGN_WINDOW = 300
+
+	// 带密钥的签名放在请求头中，不随请求内容写入日志
+	SIGN_HEADER = "X-Content-Sign"
+)
+
+// 参数校验错误码，客户端依赖这些取值，只能新增不能修改
+const (
+	ERR_CODE_REQUIRED       = "required"
+	ERR_CODE_INVALID_FORMAT = "invalid_format"
+	ERR_CODE_INVALID_VALUE  = "invalid_value"
+	ERR_CODE_CONFLICT       = "conflict"
+	ERR_CODE_TOO_DEEP       = "too_deep"
+	ERR_CODE_SIGN           = "sign_error"
+	ERR_CODE_FORBIDDEN      = "forbidden"
+	ERR_CODE_FIELD_DENIED   = "field_denied"
+)
+
+// ValidationError 字段级的参数错误，path为出错字段在请求json中的路径，如req.must.range.pubtime
+type ValidationError struct {
+	Path    string `json:"path"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var msgs []string
+	for _, v := range e {
+		msgs = append(msgs, v.Path+": "+v.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationErrors) add(path, code, msg string) {
+	*e = append(*e, ValidationError{Path: path, Code: code, Message: msg})
+}
+
+// errorData 参数校验错误时输出错误列表，其他错误输出空data
+func errorData(err error) map[string]interface{} {
+	res := make(map[string]interface{})
+	if errs, ok := err.(ValidationErrors); ok {
+		res["errors"] = errs
+	}
+	return res
+}
+
+// inSourceList 来源是否在配置的列表中，多个来源用;分隔
+func inSourceList(key, source string) bool {
+	for _, s := range G_conf.Strings(key) {
+		if s != "" && s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecretSign 写入、管理接口与debug使用带密钥的签名，见common.CheckHmacSign
+// 密钥按来源配置在[content_secret]中，t为秒级时间戳，与服务器时间相差不能超过content::signWindow秒
+// sign取自SIGN_HEADER，body为签名覆盖的原始请求内容
+func checkSecretSign(path string, basic *CCBasic, ibiz int, sign string, body []byte) ValidationErrors {
+	var errs ValidationErrors
+	t, err := strconv.ParseInt(basic.Timestamp, 10, 64)
+	if err != nil {
+		errs.add(path+".t", ERR_CODE_INVALID_FORMAT, "t must be a unix timestamp")
+		return errs
+	}
+	window := int64(G_conf.DefaultInt("content::signWindow", DEFAULT_SIGN_WINDOW))
+	if diff := time.Now().Unix() - t; diff > window || diff < -window {
+		errs.add(path+".t", ERR_CODE_INVALID_VALUE, fmt.Sprintf("t must be within %d seconds of server time", window))
+		return errs
+	}
+	secret := G_conf.String("content_secret::" + basic.Source)
+	if !common.CheckHmacSign(sign, secret, basic.Source, basic.Timestamp, ibiz, body) {
+		errs.add(SIGN_HEADER, ERR_CODE_SIGN, "check sign error")
+	}
+	return errs
+}
+
+// validateIdentity 校验签名用到的ibiz与source，返回ibiz；path为basic在请求json中的路径
+func validateIdentity(path string, basic *CCBasic, errs *ValidationErrors) int {
+	ibiz, err := strconv.Atoi(basic.IBiz)
+	if basic.IBiz == "" {
+		errs.add(path+".ibiz", ERR_CODE_REQUIRED, "ibiz is required")
+	} else if err != nil {
+		errs.add(path+".ibiz", ERR_CODE_INVALID_FORMAT, "ibiz must be an integer")
+	}
+	if basic.Source == "" {
+		errs.add(path+".source", ERR_CODE_REQUIRED, "source is required")
+	}
+	return ibiz
+}
+
+// validateParam 校验签名之外的整个请求，收集所有错误而不是遇到第一个错误就返回
+// ibiz与source已由validateIdentity校验
+func (c *ContentController) validateParam(param *CCParamData) ValidationErrors {
+	var errs ValidationErrors
+	basic := &param.Req.Basic
+
+	ibiz, _ := strconv.Atoi(basic.IBiz)
+	if basic.Page != "" {
+		page, err := strconv.Atoi(basic.Page)
+		if err != nil || page < 0 {
+			errs.add("req.basic.page", ERR_CODE_INVALID_FORMAT, "page must be a non-negative integer")
+		}
+	}
+	if basic.Pagesize != "" {
+		pagesize, err := strconv.Atoi(basic.Pagesize)
+		if err != nil || pagesize < 0 {
+			errs.add("req.basic.pagesize", ERR_CODE_INVALID_FORMAT, "pagesize must be a non-negative integer")
+		}
+	}
+	if basic.Sort != "" && basic.Desc != "" &&
+		len(strings.Split(basic.Sort, ",")) != len(strings.Split(basic.Desc, ",")) {
+		errs.add("req.basic.desc", ERR_CODE_CONFLICT, "sort and desc must have the same length")
+	}
+	if basic.Cursor != "" && cursorSecret == nil {
+		errs.add("req.basic.cursor", ERR_CODE_INVALID_VALUE, "cursor paging is not enabled")
+	} else if basic.Cursor != "" && basic.Page != "" {
+		errs.add("req.basic.cursor", ERR_CODE_CONFLICT, "page and cursor can not be used together")
+	} else if basic.Cursor != "" && basic.Cursor != CURSOR_START {
+		_, err := decodeCursor(basic.Cursor, cursorScope(basic, ibiz))
+		if err != nil {
+			errs.add("req.basic.cursor", ERR_CODE_INVALID_VALUE, err.Error())
+		}
+	}
+
+	validateRanges("req.must.range", param.Req.Must.Range, &errs)
+	for i, s := range param.Req.Must.Should {
+		validateRanges(fmt.Sprintf("req.must.should[%d].range", i), s.Range, &errs)
+	}
+	validateRanges("req.must_not.range", param.Req.MustNot.Range, &errs)
+	for i, s := range param.Req.MustNot.Should {
+		validateRanges(fmt.Sprintf("req.must_not.should[%d].range", i), s.Range, &errs)
+	}
+
+	if param.Req.Query != nil {
+		maxDepth := G_conf.DefaultInt("content::maxQueryDepth", DEFAULT_QUERY_DEPTH)
+		validateQueryNode("req.query", param.Req.Query, 1, maxDepth, &errs)
+	}
+
+	for name, a := range param.Req.Aggs {
+		if strings.HasPrefix(name, "_") {
+			errs.add("req.aggs."+name, ERR_CODE_INVALID_VALUE, "aggs name can not start with _")
+			continue
+		}
+		_, err := buildAgg(name, a, 1)
+		if err != nil {
+			errs.add("req.aggs."+name, ERR_CODE_INVALID_VALUE, err.Error())
+		}
+	}
+	if param.Req.Collapse.Field != "" {
+		_, err := c.parseCollapse(elastic.NewSearchSource(), param.Req.Collapse, param.Res)
+		if err != nil {
+			errs.add("req.collapse", ERR_CODE_INVALID_VALUE, err.Error())
+		}
+		// es6不支持折叠与search_after同时使用
+		if basic.Cursor != "" {
+			errs.add("req.collapse", ERR_CODE_CONFLICT, "collapse can not be used with cursor")
+		}
+	} else if param.Req.Collapse.InnerHits != "" || param.Req.Collapse.GroupSize != "" {
+		errs.add("req.collapse.field", ERR_CODE_REQUIRED, "collapse field is required")
+	}
+	if len(param.Req.Score.Functions) > 0 {
+		_, err := c.parseScore(elastic.NewMatchAllQuery(), param.Req.Score)
+		if err != nil {
+			errs.add("req.score", ERR_CODE_INVALID_VALUE, err.Error())
+		}
+	}
+	if len(param.Req.Highlight.Fields) > 0 {
+		_, err := c.parseHighlight(elastic.NewSearchSource(), param.Req.Highlight)
+		if err != nil {
+			errs.add("req.highlight", ERR_CODE_INVALID_VALUE, err.Error())
+		}
+	}
+
+	// range、aggs来自map，排序保证同一请求的错误顺序固定
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Path < errs[j].Path
+	})
+
+	return errs
+}
+
+func validateRanges(path string, rg map[string]string, errs *ValidationErrors) {
+	for field, value := range rg {
+		if _, err := parseRange(value); err != nil {
+			errs.add(path+"."+field, ERR_CODE_INVALID_FORMAT, err.Error())
+		}
+	}
+}
+
+func validateQueryNode(path string, node *CCQueryNode, depth, maxDepth int, errs *ValidationErrors) {
+	if depth > maxDepth {
+		errs.add(path, ERR_CODE_TOO_DEEP, fmt.Sprintf("query too deep, max depth is %d", maxDepth))
+		return
+	}
+
+	validateRanges(path+".range", node.Range, errs)
+	if node.MinimumShouldMatch != "" && len(node.Should) == 0 {
+		errs.add(path+".minimum_should_match", ERR_CODE_CONFLICT, "minimum_should_match without should")
+	}
+
+	children := []struct {
+		name  string
+		nodes []CCQueryNode
+	}{
+		{"must", node.Must},
+		{"filter", node.Filter},
+		{"must_not", node.MustNot},
+		{"should", node.Should},
+	}
+	for _, child := range children {
+		for i := range child.nodes {
+			validateQueryNode(fmt.Sprintf("%s.%s[%d]", path, child.name, i), &child.nodes[i], depth+1, maxDepth, errs)
+		}
+	}
+}
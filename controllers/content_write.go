@@ -0,0 +1,440 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	WRITE_OP_CREATE = "create"
+	WRITE_OP_INDEX  = "index"
+	WRITE_OP_UPDATE = "update"
+	WRITE_OP_DELETE = "delete"
+
+	MAX_WRITE_ID_SIZE    = 512
+	DEFAULT_MAX_DOC_SIZE = 1024 * 1024
+	MAX_BULK_SIZE        = 1000
+
+	BULK_ACTIONS          = 500
+	MAX_BULK_ITEM_RETRIES = 3
+
+	DEFAULT_INVALIDATE_INTERVAL = 10
+	DEFAULT_REFRESH_INTERVAL    = 1
+)
+
+var (
+	writeRefreshes = map[string]bool{"": true, "true": true, "false": true, "wait_for": true}
+	// 单条返回这些状态码时重试，与BulkProcessor默认的一致
+	bulkRetryStatus = map[int]bool{408: true, 429: true, 503: true, 507: true}
+
+	cacheGenerations sync.Map
+)
+
+// CCWriteDoc 单个写操作，op为create、index、update、delete
+// create的id为空时由es生成；index为整体替换，update为部分更新
+type CCWriteDoc struct {
+	Op  string          `json:"op"`
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+type CCWriteReq struct {
+	Basic CCBasic `json:"basic"`
+}
+
+// CCWriteParam 写入请求，单个写接口使用id、doc，批量接口使用docs
+// refresh为空时按wait_for处理，等es刷新后再返回并使缓存失效，见invalidateContent
+type CCWriteParam struct {
+	Req     CCWriteReq      `json:"req"`
+	Id      string          `json:"id"`
+	Doc     json.RawMessage `json:"doc"`
+	Docs    []CCWriteDoc    `json:"docs"`
+	Refresh string          `json:"refresh"`
+}
+
+// cacheGen 索引的写入代数，是响应缓存key的一部分，加一后该索引的响应缓存不再命中
+//
+// 失效是粗粒度且只对本机有效的：
+// 一次写入使整个索引的搜索缓存失效，而不只是包含该文档的响应；
+// 其他机器的搜索缓存不会失效，在过期(content_info为60秒)后才读到新数据；
+// 不再命中的旧缓存仍占用内存，直到过期后被bcache后台清理或被LRU淘汰。
+// 为避免频繁写入使缓存一直不命中，content::invalidateInterval秒内最多加一次，
+// 期间的写入合并到间隔结束时再加一次，保证最后一次写入后缓存会失效
+type cacheGen struct {
+	gen     uint64
+	mu      sync.Mutex
+	last    time.Time
+	pending bool
+}
+
+func loadCacheGen(route *ContentRoute) *cacheGen {
+	v, _ := cacheGenerations.LoadOrStore(route.Cluster+"|"+route.Index+"|"+route.Type, &cacheGen{})
+	return v.(*cacheGen)
+}
+
+func cacheGeneration(route *ContentRoute) uint64 {
+	return atomic.LoadUint64(&loadCacheGen(route).gen)
+}
+
+func (g *cacheGen) bump(interval time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pending {
+		return
+	}
+	wait := interval - time.Since(g.last)
+	if wait <= 0 {
+		atomic.AddUint64(&g.gen, 1)
+		g.last = time.Now()
+		return
+	}
+	g.pending = true
+	time.AfterFunc(wait, func() {
+		g.mu.Lock()
+		atomic.AddUint64(&g.gen, 1)
+		g.last = time.Now()
+		g.pending = false
+		g.mu.Unlock()
+	})
+}
+
+// invalidateDocs 清除本机content_base_info中的文档缓存
+func invalidateDocs(route *ContentRoute, ids []string) {
+	for _, id := range ids {
+		G_cache["content_base_info"].Del(baseInfoKey(route, id))
+	}
+}
+
+// invalidateContent 接口写入后清除文档缓存，并使该索引的搜索缓存失效，见cacheGen
+// refresh为false时写入还不可见，此时失效后的查询仍会把旧结果缓存到新的代数下，
+// 所以在es刷新间隔(content::refreshInterval秒，与索引的refresh_interval一致)之后再失效一次
+func invalidateContent(route *ContentRoute, ids []string, refresh string) {
+	invalidateDocs(route, ids)
+	interval := time.Duration(G_conf.DefaultInt("content::invalidateInterval", DEFAULT_INVALIDATE_INTERVAL)) * time.Second
+	g := loadCacheGen(route)
+	g.bump(interval)
+	if refresh == "false" {
+		refreshInterval := time.Duration(G_conf.DefaultInt("content::refreshInterval", DEFAULT_REFRESH_INTERVAL)) * time.Second
+		time.AfterFunc(refreshInterval, func() {
+			g.bump(interval)
+		})
+	}
+}
+
+// validateWriteDoc prefix为字段路径的前缀，如docs[0].
+func validateWriteDoc(prefix string, doc CCWriteDoc, errs *ValidationErrors) {
+	switch doc.Op {
+	case WRITE_OP_CREATE, WRITE_OP_INDEX, WRITE_OP_UPDATE, WRITE_OP_DELETE:
+	default:
+		errs.add(prefix+"op", ERR_CODE_INVALID_VALUE, "op must be create, index, update or delete")
+		return
+	}
+
+	if doc.Id == "" && doc.Op != WRITE_OP_CREATE {
+		errs.add(prefix+"id", ERR_CODE_REQUIRED, "id is required")
+	} else if len(doc.Id) > MAX_WRITE_ID_SIZE {
+		errs.add(prefix+"id", ERR_CODE_INVALID_VALUE, fmt.Sprintf("id must be at most %d bytes", MAX_WRITE_ID_SIZE))
+	}
+
+	if doc.Op == WRITE_OP_DELETE {
+		if len(doc.Doc) > 0 {
+			errs.add(prefix+"doc", ERR_CODE_CONFLICT, "doc can not be used with delete")
+		}
+		return
+	}
+	if len(doc.Doc) == 0 {
+		errs.add(prefix+"doc", ERR_CODE_REQUIRED, "doc is required")
+		return
+	}
+	maxSize := G_conf.DefaultInt("content::maxDocSize", DEFAULT_MAX_DOC_SIZE)
+	if len(doc.Doc) > maxSize {
+		errs.add(prefix+"doc", ERR_CODE_INVALID_VALUE, fmt.Sprintf("doc must be at most %d bytes", maxSize))
+		return
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(doc.Doc, &fields); err != nil || fields == nil {
+		errs.add(prefix+"doc", ERR_CODE_INVALID_FORMAT, "doc must be a json object")
+	}
+}
+
+// prepareWrite 解析写入请求，校验带密钥的签名并找到路由，仅content::writeSources中的来源可写
+func (c *ContentController) prepareWrite(res interface{}) (*CCWriteParam, *ContentRoute) {
+	var param CCWriteParam
+	err := json.Unmarshal(c.Ctx.Input.RequestBody, &param)
+	if err != nil {
+		c.outMsg(-1, "invalid post data. err: "+err.Error(), res)
+	}
+	c.AppendCtx(fmt.Sprintf("reqparam=[%s]", string(c.Ctx.Input.RequestBody)))
+
+	basic := &param.Req.Basic
+	var errs ValidationErrors
+	ibiz := validateIdentity("req.basic", basic, &errs)
+	if len(errs) == 0 {
+		errs = checkSecretSign("req.basic", basic, ibiz, c.Ctx.Input.Header(SIGN_HEADER), c.Ctx.Input.RequestBody)
+	}
+	if len(errs) == 0 && !inSourceList("content::writeSources", basic.Source) {
+		errs.add("req.basic.source", ERR_CODE_FORBIDDEN, "source is not allowed to write")
+	}
+	if !writeRefreshes[param.Refresh] {
+		errs.add("refresh", ERR_CODE_INVALID_VALUE, "refresh must be true, false or wait_for")
+	}
+	if param.Refresh == "" {
+		param.Refresh = "wait_for"
+	}
+	if len(errs) > 0 {
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+
+	c.IBiz = ibiz
+	c.Param.Req.Basic = *basic
+	route, err := G_router.Lookup(ibiz, basic.Source)
+	if err != nil {
+		c.outMsg(-1, "invalid ibiz route", res)
+	}
+	c.esClient = G_ec[route.Cluster]
+
+	return &param, route
+}
+
+// writeDoc 单个写接口，op由接口决定
+func (c *ContentController) writeDoc(op string) {
+	var err error
+	res := make(map[string]interface{})
+
+	param, route := c.prepareWrite(res)
+	doc := CCWriteDoc{Op: op, Id: param.Id, Doc: param.Doc}
+	var errs ValidationErrors
+	validateWriteDoc("", doc, &errs)
+	if len(errs) > 0 {
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+
+	client := c.esClient.Client
+	var id, result string
+	var version int64
+	switch op {
+	case WRITE_OP_CREATE, WRITE_OP_INDEX:
+		svc := client.Index().Index(route.Index).Type(route.Type).OpType(op).BodyJson(doc.Doc).Refresh(param.Refresh)
+		if doc.Id != "" {
+			svc = svc.Id(doc.Id)
+		}
+		var r *elastic.IndexResponse
+		r, err = svc.Do(context.TODO())
+		if err == nil {
+			id, version, result = r.Id, r.Version, r.Result
+		}
+	case WRITE_OP_UPDATE:
+		var r *elastic.UpdateResponse
+		r, err = client.Update().Index(route.Index).Type(route.Type).Id(doc.Id).Doc(doc.Doc).RetryOnConflict(3).Refresh(param.Refresh).Do(context.TODO())
+		if err == nil {
+			id, version, result = r.Id, r.Version, r.Result
+		}
+	case WRITE_OP_DELETE:
+		var r *elastic.DeleteResponse
+		r, err = client.Delete().Index(route.Index).Type(route.Type).Id(doc.Id).Refresh(param.Refresh).Do(context.TODO())
+		if err == nil {
+			id, version, result = r.Id, r.Version, r.Result
+		}
+	}
+	if elastic.IsConflict(err) {
+		c.outMsg(-1, "content already exists", res)
+	}
+	if elastic.IsNotFound(err) {
+		c.outMsg(-1, ErrContentNotFound.Error(), res)
+	}
+	if err != nil {
+		c.outMsg(-1, err.Error(), res)
+	}
+	invalidateContent(route, []string{id}, param.Refresh)
+
+	res["id"] = id
+	res["version"] = version
+	res["result"] = result
+
+	c.outMsg(0, "OK", res)
+}
+
+// CreateDoc 新建文档，id已存在时失败
+func (c *ContentController) CreateDoc() {
+	c.writeDoc(WRITE_OP_CREATE)
+}
+
+// UpdateDoc 整体替换文档，不存在时新建
+func (c *ContentController) UpdateDoc() {
+	c.writeDoc(WRITE_OP_INDEX)
+}
+
+// PatchDoc 部分更新文档，只修改doc中的字段
+func (c *ContentController) PatchDoc() {
+	c.writeDoc(WRITE_OP_UPDATE)
+}
+
+// DeleteDoc 删除文档
+func (c *ContentController) DeleteDoc() {
+	c.writeDoc(WRITE_OP_DELETE)
+}
+
+// BulkDoc 批量写入，通过BulkProcessor提交，整个请求失败时按退避重试，
+// 单条返回408、429、503、507时重新提交该条，返回每条的结果
+// BulkProcessor不支持refresh参数，refresh为true时写完后刷新索引，其他情况按false使缓存失效
+func (c *ContentController) BulkDoc() {
+	res := make(map[string]interface{})
+
+	param, route := c.prepareWrite(res)
+	var errs ValidationErrors
+	if len(param.Docs) == 0 || len(param.Docs) > MAX_BULK_SIZE {
+		errs.add("docs", ERR_CODE_INVALID_VALUE, fmt.Sprintf("docs size must be between 1 and %d", MAX_BULK_SIZE))
+	}
+	for i, doc := range param.Docs {
+		validateWriteDoc(fmt.Sprintf("docs[%d].", i), doc, &errs)
+	}
+	if len(errs) > 0 {
+		c.outMsg(-1, errs.Error(), errorData(errs))
+	}
+
+	items := c.bulkWrite(route, param.Docs)
+	failed := 0
+	var ids []string
+	for _, item := range items {
+		if item["status"] != 0 {
+			failed++
+		}
+		if id, _ := item["id"].(string); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	refresh := "false"
+	if param.Refresh == "true" {
+		_, err := c.esClient.Client.Refresh(route.Index).Do(context.TODO())
+		if err == nil {
+			refresh = "true"
+		}
+	}
+	invalidateContent(route, ids, refresh)
+
+	res["items"] = items
+	res["failed"] = failed
+
+	c.outMsg(0, "OK", res)
+}
+
+func bulkRequest(route *ContentRoute, doc CCWriteDoc) elastic.BulkableRequest {
+	switch doc.Op {
+	case WRITE_OP_UPDATE:
+		return elastic.NewBulkUpdateRequest().Index(route.Index).Type(route.Type).Id(doc.Id).Doc(doc.Doc).RetryOnConflict(3)
+	case WRITE_OP_DELETE:
+		return elastic.NewBulkDeleteRequest().Index(route.Index).Type(route.Type).Id(doc.Id)
+	}
+	r := elastic.NewBulkIndexRequest().Index(route.Index).Type(route.Type).OpType(doc.Op).Doc(doc.Doc)
+	if doc.Id != "" {
+		r = r.Id(doc.Id)
+	}
+	return r
+}
+
+// bulkWrite 关闭BulkProcessor的单条重试，使每次提交的响应与请求一一对应，
+// 需要重试的单条在下一轮重新提交，最多MAX_BULK_ITEM_RETRIES轮
+func (c *ContentController) bulkWrite(route *ContentRoute, docs []CCWriteDoc) []map[string]interface{} {
+	results := make([]map[string]interface{}, len(docs))
+	pending := make([]int, len(docs))
+	for i := range docs {
+		pending[i] = i
+	}
+
+	backoff := elastic.NewExponentialBackoff(100*time.Millisecond, 5*time.Second)
+	for retry := 0; len(pending) > 0; retry++ {
+		var mu sync.Mutex
+		var retries []int
+
+		// 请求在提交前全部生成，After回调中只读；按原顺序提交，同一id的多个操作按顺序生效
+		reqs := make([]elastic.BulkableRequest, 0, len(pending))
+		requests := make(map[elastic.BulkableRequest]int, len(pending))
+		for _, i := range pending {
+			r := bulkRequest(route, docs[i])
+			reqs = append(reqs, r)
+			requests[r] = i
+		}
+
+		p, err := c.esClient.Client.BulkProcessor().
+			Name("content_bulk").
+			Workers(1).
+			BulkActions(BULK_ACTIONS).
+			Backoff(backoff).
+			RetryItemStatusCodes().
+			After(func(executionId int64, committed []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				for n, r := range committed {
+					i := requests[r]
+					if err != nil || response == nil || n >= len(response.Items) {
+						results[i] = bulkResult(docs[i], nil, err)
+						continue
+					}
+					for _, item := range response.Items[n] {
+						if bulkRetryStatus[item.Status] && retry < MAX_BULK_ITEM_RETRIES {
+							retries = append(retries, i)
+							continue
+						}
+						results[i] = bulkResult(docs[i], item, nil)
+					}
+				}
+			}).
+			Do(context.Background())
+		if err != nil {
+			for _, i := range pending {
+				results[i] = bulkResult(docs[i], nil, err)
+			}
+			break
+		}
+		for _, r := range reqs {
+			p.Add(r)
+		}
+		p.Close()
+
+		pending = retries
+		if len(pending) > 0 {
+			wait, _ := backoff.Next(retry)
+			time.Sleep(wait)
+		}
+	}
+	for i := range results {
+		if results[i] == nil {
+			results[i] = bulkResult(docs[i], nil, nil)
+		}
+	}
+
+	return results
+}
+
+func bulkResult(doc CCWriteDoc, item *elastic.BulkResponseItem, err error) map[string]interface{} {
+	res := map[string]interface{}{
+		"op":     doc.Op,
+		"id":     doc.Id,
+		"status": -1,
+	}
+	if err != nil {
+		res["msg"] = err.Error()
+		return res
+	}
+	if item == nil {
+		res["msg"] = "no response"
+		return res
+	}
+	res["id"] = item.Id
+	res["version"] = item.Version
+	res["result"] = item.Result
+	if item.Error != nil {
+		res["msg"] = item.Error.Reason
+		return res
+	}
+	res["status"] = 0
+	res["msg"] = "OK"
+	return res
+}
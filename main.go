@@ -18,6 +18,21 @@ func main() {
 	}))
 
 	beego.Router("/content", &controllers.ContentController{})
+	beego.Router("/content/batch", &controllers.ContentController{}, "post:Batch")
+	beego.Router("/content/count", &controllers.ContentController{}, "post:Count")
+	beego.Router("/content/exists", &controllers.ContentController{}, "post:Exists")
+	beego.Router("/content/suggest", &controllers.ContentController{}, "post:Suggest")
+	beego.Router("/content/mget", &controllers.ContentController{}, "post:MGet")
+	beego.Router("/content/export", &controllers.ContentController{}, "post:Export")
+	beego.Router("/content/doc/create", &controllers.ContentController{}, "post:CreateDoc")
+	beego.Router("/content/doc/update", &controllers.ContentController{}, "post:UpdateDoc")
+	beego.Router("/content/doc/patch", &controllers.ContentController{}, "post:PatchDoc")
+	beego.Router("/content/doc/delete", &controllers.ContentController{}, "post:DeleteDoc")
+	beego.Router("/content/doc/bulk", &controllers.ContentController{}, "post:BulkDoc")
+	beego.Router("/content/template/save", &controllers.TemplateController{}, "post:Save")
+	beego.Router("/content/template/activate", &controllers.TemplateController{}, "post:Activate")
+	beego.Router("/content/template/versions", &controllers.TemplateController{}, "post:Versions")
+	beego.Router("/content/:id", &controllers.ContentController{}, "get:GetById")
 
 	beego.Run()
 }